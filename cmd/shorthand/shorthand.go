@@ -12,8 +12,12 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	// my packages
 	shorthand "github.com/rsdoiel/shorthand"
@@ -51,21 +55,36 @@ See: http://opensource.org/licenses/BSD-2-Clause`
 	generateMarkdown bool
 
 	// Application Options
-	prompt   string
-	noprompt bool
-	vm       *shorthand.VirtualMachine
-	lineNo   int
+	prompt         string
+	noprompt       bool
+	strict         bool
+	recursive      bool
+	indented       bool
+	labelSyntax    string
+	shell          string
+	includePath    string
+	safe           bool
+	allowCommands  string
+	allowEnv       string
+	root           string
+	readOnly       bool
+	failFast       bool
+	collectErrors  bool
+	commandTimeout time.Duration
+	runTimeout     time.Duration
+	vm             *shorthand.VirtualMachine
+	lineNo         int
 )
 
 var helpShorthand = func(vm *shorthand.VirtualMachine, sm shorthand.SourceMap) (shorthand.SourceMap, error) {
-	fmt.Printf(`
+	fmt.Fprintf(vm.Out, `
 The following operators are supported in shorthand:
 
 `)
 	for op, msg := range vm.Help {
-		fmt.Printf("\t%s\t%s\n", op, msg)
+		fmt.Fprintf(vm.Out, "\t%s\t%s\n", op, msg)
 	}
-	fmt.Printf("\nshorthand %s\n\n", shorthand.Version)
+	fmt.Fprintf(vm.Out, "\nshorthand %s\n\n", shorthand.Version)
 	return shorthand.SourceMap{Label: "", Op: ":help:", Source: "", Expanded: ""}, nil
 }
 
@@ -74,7 +93,7 @@ var exitShorthand = func(vm *shorthand.VirtualMachine, sm shorthand.SourceMap) (
 	if sm.Source == "" {
 		os.Exit(0)
 	}
-	fmt.Fprintf(os.Stderr, sm.Source)
+	fmt.Fprintf(vm.Eout, sm.Source)
 	os.Exit(1)
 	return shorthand.SourceMap{Label: "", Op: ":exit:", Source: "", Expanded: ""}, nil
 }
@@ -107,6 +126,21 @@ func main() {
 	// Application Options
 	app.StringVar(&prompt, "p,prompt", "=> ", "Output a prompt for interactive processing")
 	app.BoolVar(&noprompt, "n,no-prompt", false, "Turn off the prompt for interactive processing")
+	app.BoolVar(&strict, "strict", false, "Report labels that are used but not assigned and exit with an error if any are found")
+	app.BoolVar(&recursive, "recursive", false, "Expand text until no labels are left, reporting cycles")
+	app.BoolVar(&indented, "indented", false, "Recognize operators after leading spaces and tabs, e.g. in markdown code blocks")
+	app.StringVar(&labelSyntax, "label-syntax", "{{...}}", "How labels are written, used by -strict (e.g. {{...}} or @...)")
+	app.StringVar(&shell, "shell", "bash", "Shell used to run commands, bash, sh, none (no shell) or the path to a shell")
+	app.StringVar(&includePath, "I,include-path", "", "Directories to search for imported files separated by \""+string(os.PathListSeparator)+"\", added before $SHORTHAND_PATH")
+	app.BoolVar(&safe, "safe", false, "Process untrusted shorthand, no commands are run and files must be inside -root")
+	app.StringVar(&allowCommands, "allow-commands", "", "Comma separated commands that can be run with -safe (e.g. date,wc)")
+	app.StringVar(&allowEnv, "allow-env", "", "Comma separated variables that can be passed to commands by :bash-env: with -safe (e.g. pageTitle,author)")
+	app.StringVar(&root, "root", ".", "Directory files must be inside with -safe")
+	app.BoolVar(&readOnly, "read-only", false, "Do not write files, implies -safe")
+	app.DurationVar(&commandTimeout, "timeout", 0, "Stop each shell command that runs longer than this (e.g. 30s), zero for no limit")
+	app.DurationVar(&runTimeout, "deadline", 0, "Stop processing when the whole run takes longer than this (e.g. 5m), zero for no limit")
+	app.BoolVar(&failFast, "fail-fast", false, "Stop at the first error and exit with an error")
+	app.BoolVar(&collectErrors, "collect-errors", false, "Report every error, including those in imported files, and exit with an error if any are found")
 
 	app.Parse()
 	args := app.Args()
@@ -151,8 +185,55 @@ func main() {
 	}
 
 	vm = shorthand.New()
+	vm.In, vm.Out, vm.Eout = app.In, app.Out, app.Eout
 	vm.RegisterOp(":exit:", exitShorthand, "Exit shorthand repl")
 
+	ls, err := shorthand.ParseLabelSyntax(labelSyntax)
+	cli.ExitOnError(app.Eout, err, quiet)
+	vm.SetLabelSyntax(ls)
+	vm.SetStrict(strict)
+	vm.SetRecursive(recursive)
+	vm.SetIndented(indented)
+	if failFast && collectErrors {
+		cli.ExitOnError(app.Eout, fmt.Errorf("-fail-fast and -collect-errors can't be used together"), quiet)
+	}
+	if failFast {
+		vm.SetErrorMode(shorthand.FailFast)
+	}
+	if collectErrors {
+		vm.SetErrorMode(shorthand.CollectAll)
+	}
+	runner, err := shorthand.ParseRunner(shell)
+	cli.ExitOnError(app.Eout, err, quiet)
+	vm.Runner = runner
+	if safe || readOnly || allowCommands != "" || allowEnv != "" {
+		sandbox := &shorthand.Sandbox{Root: root, ReadOnly: readOnly}
+		for _, name := range strings.Split(allowCommands, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				sandbox.Commands = append(sandbox.Commands, name)
+			}
+		}
+		for _, name := range strings.Split(allowEnv, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				sandbox.Env = append(sandbox.Env, name)
+			}
+		}
+		vm.SetSandbox(sandbox)
+	}
+	vm.CommandTimeout = commandTimeout
+	for _, paths := range []string{includePath, os.Getenv("SHORTHAND_PATH")} {
+		for _, dir := range filepath.SplitList(paths) {
+			if dir != "" {
+				vm.IncludePath = append(vm.IncludePath, dir)
+			}
+		}
+	}
+	if runTimeout > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), runTimeout)
+		defer cancel()
+		vm.SetContext(ctx)
+	}
+
 	if noprompt == true {
 		prompt = ""
 	}
@@ -161,34 +242,39 @@ func main() {
 	// if inputFName
 	if inputFName != "" {
 		vm.SetPrompt("")
-		fp, err := os.Open(inputFName)
-		if err != nil {
-			fmt.Fprintf(app.Eout, "%s\n", err)
-		}
-		defer fp.Close()
-		reader := bufio.NewReader(fp)
-		vm.Run(reader)
+		vm.SetFilename(inputFName)
+		vm.Run(nil)
 	}
 
 	// If a filename is provided on the command line use it instead of standard input.
 	if len(args) > 0 {
 		vm.SetPrompt("")
 		for _, arg := range args {
+			if failFast && len(vm.Errors) > 0 {
+				break
+			}
 			fp, err := os.Open(arg)
 			if err != nil {
 				fmt.Fprintf(app.Eout, "%s\n", err)
+				continue
 			}
 			defer fp.Close()
 			reader := bufio.NewReader(fp)
+			vm.SetFilename(arg)
 			vm.Run(reader)
 		}
-	} else {
+	} else if inputFName == "" {
 		// Run as repl
 		vm.RegisterOp(":help:", helpShorthand, "This help message")
 		if prompt != "" {
-			fmt.Println(welcome)
+			fmt.Fprintln(vm.Out, welcome)
 		}
-		reader := bufio.NewReader(app.In)
-		vm.Run(reader)
+		vm.Run(nil)
+	}
+	if strict && len(vm.Warnings) > 0 {
+		os.Exit(1)
+	}
+	if len(vm.Errors) > 0 {
+		os.Exit(1)
 	}
 }
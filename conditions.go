@@ -0,0 +1,203 @@
+//
+// Package shorthand provides shorthand definition and expansion.
+//
+// conditions.go - Tests used by the conditional operators and the
+// sections of text they show or hide, so choosing between two values
+// doesn't need a shell.
+//
+// @author R. S. Doiel, <rsdoiel@gmail.com>
+// copyright (c) 2019 all rights reserved.
+// Released under the BSD 2-Clause license
+// See: http://opensource.org/licenses/BSD-2-Clause
+//
+package shorthand
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// IfOp starts a conditional section, e.g. ":if: not empty {{nav}}"
+	IfOp = ":if:"
+
+	// ElseOp starts the part of a conditional section used when the test
+	// is false, it also separates the two values of a conditional operator
+	ElseOp = ":else:"
+
+	// EndIfOp ends a conditional section
+	EndIfOp = ":end-if:"
+)
+
+// section is a conditional section being evaluated
+type section struct {
+	sm      SourceMap // the :if: statement
+	outer   bool      // the enclosing section is shown
+	test    bool      // the result of the test
+	hasElse bool      // :else: has been seen
+}
+
+// shown reports if the lines of the section are evaluated
+func (s section) shown() bool {
+	return s.outer && s.test != s.hasElse
+}
+
+// skipping reports if the current line is in a hidden section
+func (vm *VirtualMachine) skipping() bool {
+	return len(vm.sections) > 0 && vm.sections[len(vm.sections)-1].shown() == false
+}
+
+// isSectionOp reports if op starts, divides or ends a conditional section
+func isSectionOp(op string) bool {
+	return op == IfOp || op == ElseOp || op == EndIfOp
+}
+
+// closeSections returns an error if a conditional section has not been
+// ended, the sections are removed.
+func (vm *VirtualMachine) closeSections() error {
+	if len(vm.sections) == 0 {
+		return nil
+	}
+	sm := vm.sections[0].sm
+	vm.sections = nil
+	return &Error{SourceMap: sm, Err: fmt.Errorf("%s is not closed by %s", IfOp, EndIfOp)}
+}
+
+// cutWord returns the first word of s and the rest of s. A word in
+// single or double quotes may contain spaces.
+func cutWord(s string) (string, string, error) {
+	s = strings.TrimLeft(s, " \t")
+	if s == "" {
+		return "", "", nil
+	}
+	if s[0] == '"' || s[0] == '\'' {
+		end := strings.IndexByte(s[1:], s[0])
+		if end < 0 {
+			return "", "", fmt.Errorf("%s has an unterminated %c quote", s, s[0])
+		}
+		return s[1 : end+1], strings.TrimLeft(s[end+2:], " \t"), nil
+	}
+	end := strings.IndexAny(s, " \t")
+	if end < 0 {
+		return s, "", nil
+	}
+	return s[:end], strings.TrimLeft(s[end:], " \t"), nil
+}
+
+// cutElse splits s at the first ":else:" into the text used when a test
+// is true and the text used when it is false.
+func cutElse(s string) (string, string) {
+	for i := 0; ; {
+		j := strings.Index(s[i:], ElseOp)
+		if j < 0 {
+			return strings.TrimSpace(s), ""
+		}
+		j += i
+		end := j + len(ElseOp)
+		if (j == 0 || isSpace(s[j-1])) && (end == len(s) || isSpace(s[end])) {
+			return strings.TrimSpace(s[:j]), strings.TrimSpace(s[end:])
+		}
+		i = end
+	}
+}
+
+// isEmpty reports if label is not defined or its value is only white space
+func (vm *VirtualMachine) isEmpty(label string) bool {
+	return vm.Symbols.defined(label) == false || strings.TrimSpace(vm.Symbols.GetSymbol(label).Expanded) == ""
+}
+
+// equals reports if the value of label is the expansion of value
+func (vm *VirtualMachine) equals(label string, value string) bool {
+	return vm.Symbols.defined(label) && vm.Symbols.GetSymbol(label).Expanded == vm.Expand(value)
+}
+
+// test evaluates a condition written as "[not] defined LABEL",
+// "[not] empty LABEL" or "[not] equals LABEL VALUE".
+func (vm *VirtualMachine) test(condition string) (bool, error) {
+	name, rest, err := cutWord(condition)
+	if err != nil {
+		return false, err
+	}
+	negate := name == "not"
+	if negate {
+		if name, rest, err = cutWord(rest); err != nil {
+			return false, err
+		}
+	}
+	label, rest, err := cutWord(rest)
+	if err != nil {
+		return false, err
+	}
+	if label == "" {
+		return false, fmt.Errorf("expected a test and a label, e.g. \"not empty {{nav}}\"")
+	}
+	result := false
+	switch name {
+	case "defined":
+		result = vm.Symbols.defined(label)
+	case "empty":
+		result = vm.isEmpty(label)
+	case "equals":
+		if rest == "" {
+			return false, fmt.Errorf("equals expects a label and a value, e.g. equals {{page}} home")
+		}
+		value := ""
+		if value, rest, err = cutWord(rest); err != nil {
+			return false, err
+		}
+		result = vm.equals(label, value)
+	default:
+		return false, fmt.Errorf("unknown test %q, expected defined, empty or equals", name)
+	}
+	if rest != "" {
+		return false, fmt.Errorf("unexpected %q after the test", rest)
+	}
+	return result != negate, nil
+}
+
+// startSection evaluates the test of an :if: statement and starts a
+// section. Inside a hidden section the test isn't evaluated.
+func (vm *VirtualMachine) startSection(sm SourceMap) error {
+	sm.Column = 1
+	if vm.skipping() {
+		vm.sections = append(vm.sections, section{sm: sm})
+		return nil
+	}
+	ok, err := vm.test(strings.TrimSpace(sm.Label + " " + sm.Source))
+	if err != nil {
+		// Both parts of the section are hidden
+		vm.sections = append(vm.sections, section{sm: sm})
+		return &Error{SourceMap: sm, Err: err}
+	}
+	vm.sections = append(vm.sections, section{sm: sm, outer: true, test: ok})
+	return nil
+}
+
+// elseSection switches the current section to the part used when its
+// test is false
+func (vm *VirtualMachine) elseSection(sm SourceMap) error {
+	if len(vm.sections) == 0 {
+		return fmt.Errorf("%s without %s", ElseOp, IfOp)
+	}
+	current := &vm.sections[len(vm.sections)-1]
+	if current.hasElse {
+		return fmt.Errorf("%s already used by the %s at line %d", ElseOp, IfOp, current.sm.LineNo)
+	}
+	current.hasElse = true
+	if sm.Label != "" {
+		return fmt.Errorf("unexpected %q after %s", strings.TrimSpace(sm.Label+" "+sm.Source), ElseOp)
+	}
+	return nil
+}
+
+// endSection ends the current section
+func (vm *VirtualMachine) endSection(sm SourceMap) error {
+	if len(vm.sections) == 0 {
+		return fmt.Errorf("%s without %s", EndIfOp, IfOp)
+	}
+	vm.sections = vm.sections[:len(vm.sections)-1]
+	if sm.Label != "" {
+		return fmt.Errorf("unexpected %q after %s", strings.TrimSpace(sm.Label+" "+sm.Source), EndIfOp)
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+//
+// Package shorthand provides shorthand definition and expansion.
+//
+// errors.go - Errors found evaluating shorthand are reported with the
+// file, line and column they were found at so editors can jump to them.
+// The kind of failure can be checked with errors.Is and errors.As.
+//
+// @author R. S. Doiel, <rsdoiel@gmail.com>
+// copyright (c) 2019 all rights reserved.
+// Released under the BSD 2-Clause license
+// See: http://opensource.org/licenses/BSD-2-Clause
+//
+package shorthand
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrUnknownOperator matches an UnknownOperatorError with errors.Is
+	ErrUnknownOperator = errors.New("unknown operator")
+
+	// ErrIO matches an IOError with errors.Is
+	ErrIO = errors.New("I/O error")
+
+	// ErrShell matches a ShellError with errors.Is
+	ErrShell = errors.New("shell command failed")
+
+	// ErrReadOnly is returned when writing a file to a read only sandbox
+	ErrReadOnly = errors.New("files are read only")
+)
+
+// positioned is implemented by errors that hold a SourceMap
+type positioned interface {
+	error
+	source() *SourceMap
+}
+
+// Error is an error found evaluating the shorthand in SourceMap
+type Error struct {
+	SourceMap SourceMap
+	Err       error
+}
+
+// Error returns the message prefixed by file:line:col
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.SourceMap.Position(), e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) source() *SourceMap {
+	return &e.SourceMap
+}
+
+// UnknownOperatorError is returned by EvalSymbol when the SourceMap's Op
+// has no function in Operators. Parsed text can't cause it, a line that
+// starts with an unregistered operator is text.
+type UnknownOperatorError struct {
+	SourceMap SourceMap
+}
+
+// Error returns the message prefixed by file:line:col
+func (e *UnknownOperatorError) Error() string {
+	sm := e.SourceMap
+	return fmt.Sprintf("%s: `%s %s %s` is not a supported assignment", sm.Position(), sm.Op, sm.Label, sm.Source)
+}
+
+// Is reports if target is ErrUnknownOperator
+func (e *UnknownOperatorError) Is(target error) bool {
+	return target == ErrUnknownOperator
+}
+
+func (e *UnknownOperatorError) source() *SourceMap {
+	return &e.SourceMap
+}
+
+// IOError is returned when an operator can't read or write a file. Op
+// is "read" or "write" and Path is the file.
+type IOError struct {
+	SourceMap SourceMap
+	Op        string
+	Path      string
+	Err       error
+}
+
+// Error returns the message prefixed by file:line:col
+func (e *IOError) Error() string {
+	return fmt.Sprintf("%s: cannot %s %s: %s", e.SourceMap.Position(), e.Op, e.Path, e.Err)
+}
+
+// Unwrap returns the underlying error, e.g. fs.ErrNotExist
+func (e *IOError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports if target is ErrIO
+func (e *IOError) Is(target error) bool {
+	return target == ErrIO
+}
+
+func (e *IOError) source() *SourceMap {
+	return &e.SourceMap
+}
+
+// ShellError is returned when a command run by a shell operator fails.
+// A command that ran and failed has a non-zero Status and what it wrote
+// to standard error in Stderr. A command that couldn't be run, was
+// refused or was stopped has the reason in Err.
+type ShellError struct {
+	SourceMap SourceMap
+	Command   string
+	Status    int
+	Stderr    string
+	Err       error
+}
+
+// Error returns the message prefixed by file:line:col
+func (e *ShellError) Error() string {
+	if e.Status == 0 {
+		return fmt.Sprintf("%s: command %q: %s", e.SourceMap.Position(), e.Command, e.Err)
+	}
+	msg := fmt.Sprintf("%s: command %q failed with exit status %d", e.SourceMap.Position(), e.Command, e.Status)
+	if stderr := strings.TrimSpace(e.Stderr); stderr != "" {
+		msg += ": " + stderr
+	}
+	return msg
+}
+
+// Unwrap returns the underlying error, e.g. context.DeadlineExceeded
+func (e *ShellError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports if target is ErrShell
+func (e *ShellError) Is(target error) bool {
+	return target == ErrShell
+}
+
+func (e *ShellError) source() *SourceMap {
+	return &e.SourceMap
+}
+
+// ErrorList holds the errors collected when the VM's ErrorMode is
+// CollectAll. errors.Is and errors.As check each error in the list.
+type ErrorList []error
+
+// Error returns each error on its own line
+func (l ErrorList) Error() string {
+	lines := []string{}
+	for _, err := range l {
+		lines = append(lines, err.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Is reports if any error in the list matches target
+func (l ErrorList) Is(target error) bool {
+	for _, err := range l {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first error in the list that matches target
+func (l ErrorList) As(target interface{}) bool {
+	for _, err := range l {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// add appends err to the list, the errors of an ErrorList are added one at a time
+func (l *ErrorList) add(err error) {
+	if list, ok := err.(ErrorList); ok {
+		*l = append(*l, list...)
+		return
+	}
+	*l = append(*l, err)
+}
+
+// atSource returns err with the position of sm. An error that already
+// has a position, e.g. from a file being imported, is returned as is.
+func atSource(sm SourceMap, err error) error {
+	if err == nil {
+		return nil
+	}
+	var p positioned
+	if errors.As(err, &p) {
+		if p.source().LineNo == 0 {
+			*p.source() = sm
+		}
+		return err
+	}
+	return &Error{SourceMap: sm, Err: err}
+}
@@ -0,0 +1,240 @@
+//
+// Package shorthand provides shorthand definition and expansion.
+//
+// expand.go - A single pass, multi-pattern label expander based on
+// an Aho-Corasick automaton. The automaton is built from the labels in
+// a SymbolTable and only rebuilt when the table changes.
+//
+// @author R. S. Doiel, <rsdoiel@gmail.com>
+// copyright (c) 2019 all rights reserved.
+// Released under the BSD 2-Clause license
+// See: http://opensource.org/licenses/BSD-2-Clause
+//
+package shorthand
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// errExpansionSize is returned by expand when the result grows too large
+var errExpansionSize = errors.New("expansion too large")
+
+// acNode is a state in the automaton
+type acNode struct {
+	next  map[byte]int // goto transitions
+	fail  int          // state to fall back to on a mismatch
+	depth int          // length of the prefix this state represents
+	match int          // longest label ending in this state, -1 if none
+}
+
+// expander replaces labels with their values in a single pass over the text
+type expander struct {
+	nodes  []acNode
+	labels []string
+	values []string
+}
+
+// newExpander builds an automaton for the labels in symbols. Empty
+// labels are skipped.
+func newExpander(symbols []SourceMap) *expander {
+	e := new(expander)
+	e.nodes = []acNode{{next: map[byte]int{}, match: -1}}
+	for _, sm := range symbols {
+		if sm.Label == "" {
+			continue
+		}
+		state := 0
+		for i := 0; i < len(sm.Label); i++ {
+			c := sm.Label[i]
+			next, ok := e.nodes[state].next[c]
+			if ok == false {
+				e.nodes = append(e.nodes, acNode{next: map[byte]int{}, depth: i + 1, match: -1})
+				next = len(e.nodes) - 1
+				e.nodes[state].next[c] = next
+			}
+			state = next
+		}
+		e.nodes[state].match = len(e.labels)
+		e.labels = append(e.labels, sm.Label)
+		e.values = append(e.values, sm.Expanded)
+	}
+
+	// Breadth first walk to set the failure links. A state without a
+	// label of its own inherits the longest label of its failure state.
+	queue := []int{}
+	for _, next := range e.nodes[0].next {
+		queue = append(queue, next)
+	}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		for c, next := range e.nodes[state].next {
+			fail := e.nodes[state].fail
+			for {
+				if to, ok := e.nodes[fail].next[c]; ok {
+					e.nodes[next].fail = to
+					break
+				}
+				if fail == 0 {
+					break
+				}
+				fail = e.nodes[fail].fail
+			}
+			if e.nodes[next].match < 0 {
+				e.nodes[next].match = e.nodes[e.nodes[next].fail].match
+			}
+			queue = append(queue, next)
+		}
+	}
+	return e
+}
+
+// step follows the transition for c from state
+func (e *expander) step(state int, c byte) int {
+	for {
+		if next, ok := e.nodes[state].next[c]; ok {
+			return next
+		}
+		if state == 0 {
+			return 0
+		}
+		state = e.nodes[state].fail
+	}
+}
+
+// find returns the start and index of the leftmost longest label in
+// text beginning the search at from. The index is -1 if no label is found.
+func (e *expander) find(text string, from int) (int, int) {
+	start, found := -1, -1
+	state := 0
+	for i := from; i < len(text); i++ {
+		state = e.step(state, text[i])
+		if m := e.nodes[state].match; m >= 0 {
+			// Labels ending here all end at i, the longest starts first.
+			s := i + 1 - len(e.labels[m])
+			if found < 0 || s < start || (s == start && len(e.labels[m]) > len(e.labels[found])) {
+				start, found = s, m
+			}
+		}
+		// No label that is still in progress can start at or
+		// before the one we've found so it is the leftmost longest.
+		if found >= 0 && i+1-e.nodes[state].depth > start {
+			break
+		}
+	}
+	return start, found
+}
+
+// replace returns text with each leftmost longest label replaced by its
+// value. Replaced values are not scanned again.
+func (e *expander) replace(text string) string {
+	result, _ := e.expand(text, 0, func(i int, start int) (string, error) {
+		return e.values[i], nil
+	})
+	return result
+}
+
+// expand returns text with each leftmost longest label replaced by the
+// result of calling value with the label's index and its byte offset
+// in text. The first error
+// returned by value stops the expansion. If limit is greater than zero
+// and the result grows beyond limit bytes errExpansionSize is returned.
+//
+// A backslash before a label escapes it, the label is written without
+// the backslash and is not replaced. A run of backslashes before a label
+// is halved so "\\" followed by a label writes one backslash and the
+// label's value.
+func (e *expander) expand(text string, limit int, value func(int, int) (string, error)) (string, error) {
+	if len(e.labels) == 0 {
+		return text, nil
+	}
+	var result strings.Builder
+	last := 0
+	for last < len(text) {
+		start, found := e.find(text, last)
+		if found < 0 {
+			break
+		}
+		escapes := 0
+		for start-escapes > last && text[start-escapes-1] == '\\' {
+			escapes++
+		}
+		result.WriteString(text[last : start-escapes])
+		result.WriteString(strings.Repeat("\\", escapes/2))
+		if escapes%2 == 1 {
+			result.WriteString(e.labels[found])
+		} else {
+			s, err := value(found, start)
+			if err != nil {
+				return "", err
+			}
+			result.WriteString(s)
+		}
+		if limit > 0 && result.Len() > limit {
+			return "", errExpansionSize
+		}
+		last = start + len(e.labels[found])
+	}
+	if last == 0 {
+		return text, nil
+	}
+	result.WriteString(text[last:])
+	if limit > 0 && result.Len() > limit {
+		return "", errExpansionSize
+	}
+	return result.String(), nil
+}
+
+// ExpandRecursive expands the labels in text and then the labels in
+// each substituted value until none are left (a fixed point). A label
+// that refers back to itself, directly or through other labels, is an
+// error listing the chain of labels. The depth of the chain is limited
+// by MaxDepth and the size of the result by MaxExpansionSize so a
+// definition like the "billion laughs" cannot exhaust memory, a limit
+// of zero is no limit.
+func (vm *VirtualMachine) ExpandRecursive(text string) (string, error) {
+	e := vm.getExpander()
+	resolved := map[int]string{}
+	// column is where undefined labels are reported, zero for their own position
+	var expand func(string, []int, int) (string, error)
+	expand = func(text string, chain []int, column int) (string, error) {
+		vm.checkLabels(text, column)
+		return e.expand(text, vm.MaxExpansionSize, func(i int, start int) (string, error) {
+			if s, ok := resolved[i]; ok {
+				return s, nil
+			}
+			for j, k := range chain {
+				if k == i {
+					labels := []string{}
+					for _, k := range chain[j:] {
+						labels = append(labels, e.labels[k])
+					}
+					return "", fmt.Errorf("expansion cycle %s -> %s", strings.Join(labels, " -> "), e.labels[i])
+				}
+			}
+			if vm.MaxDepth > 0 && len(chain) >= vm.MaxDepth {
+				return "", fmt.Errorf("expansion of %s exceeds the maximum depth of %d", e.labels[i], vm.MaxDepth)
+			}
+			at := column
+			if at == 0 {
+				at = vm.labelColumn(text, start)
+			}
+			s, err := expand(e.values[i], append(chain, i), at)
+			if err == errExpansionSize {
+				return "", fmt.Errorf("expansion of %s exceeds the maximum size of %d bytes", e.labels[i], vm.MaxExpansionSize)
+			}
+			if err != nil {
+				return "", err
+			}
+			resolved[i] = s
+			return s, nil
+		})
+	}
+	result, err := expand(text, []int{}, 0)
+	if err == errExpansionSize {
+		return "", fmt.Errorf("expansion exceeds the maximum size of %d bytes", vm.MaxExpansionSize)
+	}
+	return result, err
+}
@@ -0,0 +1,370 @@
+//
+// Package shorthand provides shorthand definition and expansion.
+//
+// fs.go - The filesystems operators read and write files with. By
+// default files come from the operating system but templates can be
+// served from an embed.FS or kept in memory.
+//
+// @author R. S. Doiel, <rsdoiel@gmail.com>
+// copyright (c) 2019 all rights reserved.
+// Released under the BSD 2-Clause license
+// See: http://opensource.org/licenses/BSD-2-Clause
+//
+package shorthand
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WriteFS is a filesystem operators can write files to
+type WriteFS interface {
+	// Create creates or truncates the named file
+	Create(name string) (io.WriteCloser, error)
+}
+
+// OSFileSystem reads and writes files with the os package. Unlike
+// os.DirFS names are used as given so they can be absolute or
+// relative to the working directory.
+type OSFileSystem struct{}
+
+// Open opens the named file for reading
+func (OSFileSystem) Open(name string) (fs.File, error) {
+	return os.Open(name)
+}
+
+// ReadFile reads the named file
+func (OSFileSystem) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(name)
+}
+
+// Stat describes the named file
+func (OSFileSystem) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+// Create creates or truncates the named file
+func (OSFileSystem) Create(name string) (io.WriteCloser, error) {
+	return os.Create(name)
+}
+
+// MemFS is an in-memory filesystem that can be read and written, it
+// is useful for tests and for building pages without touching the disk.
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+// NewMemFS returns an empty MemFS
+func NewMemFS() *MemFS {
+	return &MemFS{files: map[string][]byte{}}
+}
+
+// memName cleans name and checks it is a valid fs.FS name
+func memName(op string, name string) (string, error) {
+	name = path.Clean(filepath.ToSlash(name))
+	if fs.ValidPath(name) == false {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return name, nil
+}
+
+// WriteFile sets the contents of the named file
+func (m *MemFS) WriteFile(name string, data []byte) error {
+	name, err := memName("write", name)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[name] = append([]byte{}, data...)
+	return nil
+}
+
+// ReadFile returns the contents of the named file
+func (m *MemFS) ReadFile(name string) ([]byte, error) {
+	name, err := memName("read", name)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.files[name]
+	if ok == false {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrNotExist}
+	}
+	return append([]byte{}, data...), nil
+}
+
+// Names returns the names of the files in sorted order
+func (m *MemFS) Names() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := []string{}
+	for name := range m.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Open opens the named file for reading
+func (m *MemFS) Open(name string) (fs.File, error) {
+	data, err := m.ReadFile(name)
+	if err != nil {
+		if pe, ok := err.(*fs.PathError); ok {
+			pe.Op = "open"
+		}
+		return nil, err
+	}
+	return &memFile{Reader: bytes.NewReader(data), info: memFileInfo{name: path.Base(name), size: int64(len(data))}}, nil
+}
+
+// Create creates or truncates the named file. What is written is
+// saved when the file is closed.
+func (m *MemFS) Create(name string) (io.WriteCloser, error) {
+	name, err := memName("create", name)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.WriteFile(name, nil); err != nil {
+		return nil, err
+	}
+	return &memWriter{fsys: m, name: name}, nil
+}
+
+// memFile is a MemFS file opened for reading
+type memFile struct {
+	*bytes.Reader
+	info memFileInfo
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *memFile) Close() error               { return nil }
+
+// memFileInfo describes a MemFS file
+type memFileInfo struct {
+	name string
+	size int64
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) Mode() fs.FileMode  { return 0444 }
+func (fi memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi memFileInfo) IsDir() bool        { return false }
+func (fi memFileInfo) Sys() interface{}   { return nil }
+
+// memWriter is a MemFS file opened for writing
+type memWriter struct {
+	fsys *MemFS
+	name string
+	buf  bytes.Buffer
+}
+
+func (w *memWriter) Write(p []byte) (int, error) { return w.buf.Write(p) }
+func (w *memWriter) Close() error                { return w.fsys.WriteFile(w.name, w.buf.Bytes()) }
+
+// readPath returns the name to use with the VM's ReadFS if the sandbox allows it
+func (vm *VirtualMachine) readPath(name string) (string, error) {
+	_, onOS := vm.ReadFS.(OSFileSystem)
+	if vm.sandbox != nil {
+		resolved, err := vm.sandbox.resolve(name, onOS)
+		if err != nil {
+			return "", err
+		}
+		name = resolved
+	}
+	if onOS == false {
+		name = path.Clean(filepath.ToSlash(name))
+	}
+	return name, nil
+}
+
+// readFile reads the named file from the VM's ReadFS if the sandbox allows it
+func (vm *VirtualMachine) readFile(name string) ([]byte, error) {
+	name, err := vm.readPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return fs.ReadFile(vm.ReadFS, name)
+}
+
+// fileExists reports if the named file can be read from the VM's ReadFS
+func (vm *VirtualMachine) fileExists(name string) bool {
+	name, err := vm.readPath(name)
+	if err != nil {
+		return false
+	}
+	_, err = fs.Stat(vm.ReadFS, name)
+	return err == nil
+}
+
+// fullPath returns name as an absolute path when files come from the
+// operating system, it is used in error messages.
+func (vm *VirtualMachine) fullPath(name string) string {
+	_, onOS := vm.ReadFS.(OSFileSystem)
+	if vm.sandbox != nil && vm.sandbox.Root != "" && filepath.IsAbs(name) == false {
+		name = filepath.Join(vm.sandbox.Root, name)
+	}
+	if onOS == false {
+		return path.Clean(filepath.ToSlash(name))
+	}
+	if abs, err := filepath.Abs(name); err == nil {
+		return abs
+	}
+	return name
+}
+
+// currentFile returns the full path of the file being evaluated, an
+// empty string if there isn't one. The file being run is named relative
+// to the working directory, imported files are named the way readPath
+// reads them.
+func (vm *VirtualMachine) currentFile() string {
+	if len(vm.imports) > 0 {
+		return vm.imports[len(vm.imports)-1].file
+	}
+	if vm.filename == "" {
+		return ""
+	}
+	if _, onOS := vm.ReadFS.(OSFileSystem); onOS {
+		if abs, err := filepath.Abs(vm.filename); err == nil {
+			return abs
+		}
+	}
+	return vm.fullPath(vm.filename)
+}
+
+// importDir returns the directory of the file doing an import named the
+// way readPath reads files. In a sandbox with a Root files are named
+// relative to the Root so it isn't added to the directory twice.
+func (vm *VirtualMachine) importDir() string {
+	_, onOS := vm.ReadFS.(OSFileSystem)
+	if len(vm.imports) > 0 || vm.sandbox == nil || vm.sandbox.Root == "" || onOS == false {
+		return filepath.Dir(vm.filename)
+	}
+	file := vm.currentFile()
+	if root, err := filepath.Abs(vm.sandbox.Root); err == nil {
+		if rel, err := filepath.Rel(root, file); err == nil && rel != ".." && strings.HasPrefix(rel, ".."+string(filepath.Separator)) == false {
+			return filepath.Dir(rel)
+		}
+	}
+	return filepath.Dir(file)
+}
+
+// resolveImport returns the path of a file named by an import operator.
+// A relative name is looked for next to the file doing the import, then
+// in the working directory and then in each directory of IncludePath.
+// If the file isn't found the path next to the importing file is returned.
+func (vm *VirtualMachine) resolveImport(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	candidates := []string{}
+	if vm.filename != "" {
+		candidates = append(candidates, filepath.Join(vm.importDir(), name))
+	}
+	candidates = append(candidates, name)
+	for _, dir := range vm.IncludePath {
+		candidates = append(candidates, filepath.Join(dir, name))
+	}
+	for _, fname := range candidates {
+		if vm.fileExists(fname) {
+			return fname
+		}
+	}
+	return candidates[0]
+}
+
+// importFile resolves and reads a file named by an import operator. The
+// error includes the full path of the file.
+func (vm *VirtualMachine) importFile(name string) (string, []byte, error) {
+	fname := vm.resolveImport(name)
+	buf, err := vm.readFile(fname)
+	if err != nil {
+		if pe, ok := err.(*fs.PathError); ok {
+			err = pe.Err
+		}
+		return fname, nil, &IOError{Op: "read", Path: vm.fullPath(fname), Err: err}
+	}
+	return fname, buf, nil
+}
+
+// createFile creates the named file in the VM's WriteFS if the sandbox allows it
+func (vm *VirtualMachine) createFile(name string) (io.WriteCloser, error) {
+	if vm.sandbox != nil {
+		if vm.sandbox.ReadOnly {
+			return nil, ErrReadOnly
+		}
+		_, onOS := vm.WriteFS.(OSFileSystem)
+		resolved, err := vm.sandbox.resolve(name, onOS)
+		if err != nil {
+			return nil, err
+		}
+		name = resolved
+	}
+	return vm.WriteFS.Create(name)
+}
+
+// writeFile writes data to the named file if the sandbox allows it
+func (vm *VirtualMachine) writeFile(name string, data []byte) error {
+	fp, err := vm.createFile(name)
+	if err != nil {
+		return err
+	}
+	if _, err := fp.Write(data); err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
+
+// importFrame is a file being imported and where it was imported from
+type importFrame struct {
+	from   string // full path of the importing file, empty if there isn't one
+	lineNo int    // line of the import in from
+	column int    // column of the filename in the import
+	file   string // full path of the imported file
+}
+
+// String returns the position of the import as file:line:col
+func (f importFrame) String() string {
+	return SourceMap{Filename: f.from, LineNo: f.lineNo, Column: f.column}.Position()
+}
+
+// pushImport records that file is imported at lineNo and column of the
+// current file. Importing a file that is already being imported is an
+// error listing the chain of imports, as is going deeper than MaxIncludeDepth.
+func (vm *VirtualMachine) pushImport(file string, lineNo int, column int) error {
+	from := vm.currentFile()
+	frames := append(vm.imports[:len(vm.imports):len(vm.imports)], importFrame{from: from, lineNo: lineNo, column: column, file: file})
+	for _, f := range frames {
+		if f.from == file {
+			chain := []string{}
+			for _, f := range frames {
+				chain = append(chain, f.String())
+			}
+			return fmt.Errorf("import cycle %s -> %s", strings.Join(chain, " -> "), file)
+		}
+	}
+	if vm.MaxIncludeDepth > 0 && len(frames) > vm.MaxIncludeDepth {
+		return fmt.Errorf("import of %s exceeds the maximum include depth of %d", file, vm.MaxIncludeDepth)
+	}
+	vm.imports = frames
+	return nil
+}
+
+// popImport removes the innermost import
+func (vm *VirtualMachine) popImport() {
+	vm.imports = vm.imports[:len(vm.imports)-1]
+}
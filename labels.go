@@ -0,0 +1,137 @@
+//
+// Package shorthand provides shorthand definition and expansion.
+//
+// labels.go - Describes how labels are written so strict mode can
+// report labels that are used but never assigned.
+//
+// @author R. S. Doiel, <rsdoiel@gmail.com>
+// copyright (c) 2019 all rights reserved.
+// Released under the BSD 2-Clause license
+// See: http://opensource.org/licenses/BSD-2-Clause
+//
+package shorthand
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// LabelSyntax describes how labels are written. A label starts with
+// Prefix and ends with Suffix. When Suffix is an empty string the
+// label is Prefix followed by a run of letters, digits and underscores
+// (e.g. @pageTitle).
+type LabelSyntax struct {
+	Prefix string
+	Suffix string
+}
+
+var (
+	// CurlyBraces is the label syntax used in the documentation, e.g. {{pageTitle}}
+	CurlyBraces = LabelSyntax{Prefix: "{{", Suffix: "}}"}
+
+	// AtSign is the label syntax of a word starting with an at sign, e.g. @pageTitle
+	AtSign = LabelSyntax{Prefix: "@"}
+)
+
+// ParseLabelSyntax takes a description of a label syntax where "..."
+// stands for the name of the label, e.g. "{{...}}" or "@...".
+func ParseLabelSyntax(s string) (LabelSyntax, error) {
+	parts := strings.SplitN(s, "...", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return LabelSyntax{}, fmt.Errorf("label syntax %q should be in the form PREFIX...SUFFIX, e.g. {{...}} or @...", s)
+	}
+	return LabelSyntax{Prefix: parts[0], Suffix: parts[1]}, nil
+}
+
+// String returns the syntax in the form accepted by ParseLabelSyntax
+func (ls LabelSyntax) String() string {
+	return ls.Prefix + "..." + ls.Suffix
+}
+
+// isWordRune reports if r can be part of a label without a suffix
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// FindLabels returns the labels written in text using the syntax.
+// Labels escaped with a backslash are skipped.
+func (ls LabelSyntax) FindLabels(text string) []string {
+	labels, _ := ls.findLabels(text)
+	return labels
+}
+
+// findLabels returns the labels written in text and their byte offsets
+func (ls LabelSyntax) findLabels(text string) ([]string, []int) {
+	labels, offsets := []string{}, []int{}
+	for i := 0; i < len(text); {
+		start := strings.Index(text[i:], ls.Prefix)
+		if start < 0 {
+			break
+		}
+		start += i
+		i = start + len(ls.Prefix)
+
+		end := i
+		if ls.Suffix == "" {
+			for end < len(text) {
+				r, size := utf8.DecodeRuneInString(text[end:])
+				if isWordRune(r) == false {
+					break
+				}
+				end += size
+			}
+		} else {
+			n := strings.Index(text[i:], ls.Suffix)
+			if n < 0 || strings.ContainsAny(text[i:i+n], " \t\r\n") {
+				continue
+			}
+			end = i + n + len(ls.Suffix)
+		}
+		if end == i {
+			continue
+		}
+		escapes := 0
+		for start-escapes > 0 && text[start-escapes-1] == '\\' {
+			escapes++
+		}
+		if escapes%2 == 0 {
+			labels = append(labels, text[start:end])
+			offsets = append(offsets, start)
+		}
+		i = end
+	}
+	return labels, offsets
+}
+
+// EnvName returns the name of the environment variable for label, the
+// label without its prefix and suffix (e.g. {{pageTitle}} is pageTitle).
+// The name must be letters, digits and underscores not starting with a digit.
+func (ls LabelSyntax) EnvName(label string) (string, error) {
+	if strings.HasPrefix(label, ls.Prefix) == false || strings.HasSuffix(label, ls.Suffix) == false || len(label) <= len(ls.Prefix)+len(ls.Suffix) {
+		return "", fmt.Errorf("%s is not written as %s", label, ls)
+	}
+	name := label[len(ls.Prefix) : len(label)-len(ls.Suffix)]
+	for i, r := range name {
+		if r > unicode.MaxASCII || (r != '_' && unicode.IsLetter(r) == false && (i == 0 || unicode.IsDigit(r) == false)) {
+			return "", fmt.Errorf("%s can not be used as an environment variable name", name)
+		}
+	}
+	return name, nil
+}
+
+// Warning describes a label that was used but not assigned
+type Warning struct {
+	Filename string
+	LineNo   int
+	Column   int
+	Label    string
+}
+
+// String returns the warning prefixed by file:line:col, e.g.
+// "page.shorthand:2:5: warning: {{title}} is not defined"
+func (w Warning) String() string {
+	sm := SourceMap{Filename: w.Filename, LineNo: w.LineNo, Column: w.Column}
+	return fmt.Sprintf("%s: warning: %s is not defined", sm.Position(), w.Label)
+}
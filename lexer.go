@@ -0,0 +1,342 @@
+//
+// Package shorthand provides shorthand definition and expansion.
+//
+// lexer.go - A tokenizer for lines of shorthand. Operators are only
+// recognized when they start a line so prose that mentions an operator
+// (e.g. documentation about shorthand) is left alone.
+//
+// @author R. S. Doiel, <rsdoiel@gmail.com>
+// copyright (c) 2019 all rights reserved.
+// Released under the BSD 2-Clause license
+// See: http://opensource.org/licenses/BSD-2-Clause
+//
+package shorthand
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// TokenType identifies the kind of text held by a Token
+type TokenType int
+
+const (
+	// TextToken is a line (or remainder of a line) that is not part of an assignment
+	TextToken TokenType = iota
+	// OperatorToken is an operator found at the start of a line, e.g. ":set:"
+	OperatorToken
+	// LabelToken is the label following an operator
+	LabelToken
+	// SourceToken is the remainder of an assignment following the label
+	SourceToken
+	// CommentToken is the text following the comment operator
+	CommentToken
+)
+
+const (
+	// CommentOp starts a comment, the rest of the line is dropped from the output.
+	// A block comment is written as a heredoc, e.g. ":comment: <<END".
+	CommentOp = ":comment:"
+)
+
+// String returns a readable name for a TokenType
+func (t TokenType) String() string {
+	switch t {
+	case TextToken:
+		return "text"
+	case OperatorToken:
+		return "operator"
+	case LabelToken:
+		return "label"
+	case SourceToken:
+		return "source"
+	case CommentToken:
+		return "comment"
+	}
+	return "unknown"
+}
+
+// Token holds a typed fragment of a line along with its position.
+// LineNo is the line number passed to Tokenize and Column is the
+// one based byte offset of Value in the line.
+type Token struct {
+	Type   TokenType
+	Value  string
+	LineNo int
+	Column int
+}
+
+// isSpace reports if c separates the fields of an assignment
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t'
+}
+
+// skipSpace returns the position of the first non-space character at or after i
+func skipSpace(s string, i int) int {
+	for i < len(s) && isSpace(s[i]) {
+		i++
+	}
+	return i
+}
+
+// leadingOp returns the operator from ops that starts s. The operator
+// must be followed by a space, tab, line ending or the end of s. When more
+// than one operator qualifies the longest is returned. An empty string
+// is returned if s does not start with an operator.
+func leadingOp(s string, ops []string) string {
+	found := ""
+	for _, op := range ops {
+		if len(op) <= len(found) || strings.HasPrefix(s, op) == false {
+			continue
+		}
+		if len(s) == len(op) || isSpace(s[len(op)]) || s[len(op)] == '\r' || s[len(op)] == '\n' {
+			found = op
+		}
+	}
+	return found
+}
+
+// Tokenize breaks a line into a list of tokens using ops as the
+// recognized operators. An operator is only recognized in the first
+// column of the line, otherwise the whole line is returned as a single
+// TextToken. A line starting with CommentOp is returned as a CommentToken.
+// A backslash before a leading operator escapes it, the line is returned
+// as a TextToken without the backslash. An assignment yields an OperatorToken followed by optional
+// LabelToken and SourceToken. Trailing whitespace and line endings are
+// not included in the Label or Source values.
+func Tokenize(s string, lineNo int, ops []string) []Token {
+	return tokenize(s, lineNo, ops, false)
+}
+
+// tokenize is Tokenize, when indented is true operators are also
+// recognized after leading spaces and tabs.
+func tokenize(s string, lineNo int, ops []string, indented bool) []Token {
+	indent := 0
+	if indented {
+		indent = skipSpace(s, 0)
+	}
+	if op := leadingOp(s[indent:], []string{CommentOp}); op != "" {
+		line := strings.TrimRight(s, " \t\r\n")
+		start := skipSpace(line, indent+len(op))
+		return []Token{{Type: CommentToken, Value: line[start:], LineNo: lineNo, Column: start + 1}}
+	}
+	rest := s[indent:]
+	if escapes := len(rest) - len(strings.TrimLeft(rest, "\\")); escapes > 0 && (leadingOp(rest[escapes:], ops) != "" || leadingOp(rest[escapes:], []string{CommentOp}) != "") {
+		// An escaped operator is text, the run of backslashes is halved
+		if indent == 0 {
+			return []Token{{Type: TextToken, Value: s[(escapes+1)/2:], LineNo: lineNo, Column: (escapes+1)/2 + 1}}
+		}
+		return []Token{{Type: TextToken, Value: s[:indent] + rest[(escapes+1)/2:], LineNo: lineNo, Column: 1}}
+	}
+	op := leadingOp(rest, ops)
+	if op == "" {
+		return []Token{{Type: TextToken, Value: s, LineNo: lineNo, Column: 1}}
+	}
+	tokens := []Token{{Type: OperatorToken, Value: op, LineNo: lineNo, Column: indent + 1}}
+	line := strings.TrimRight(s, " \t\r\n")
+
+	// Find the label
+	start := skipSpace(line, indent+len(op))
+	if start >= len(line) {
+		return tokens
+	}
+	end := start
+	for end < len(line) && isSpace(line[end]) == false && line[end] != '\r' && line[end] != '\n' {
+		end++
+	}
+	tokens = append(tokens, Token{Type: LabelToken, Value: line[start:end], LineNo: lineNo, Column: start + 1})
+
+	// Everything else is the source
+	start = skipSpace(line, end)
+	if start >= len(line) {
+		return tokens
+	}
+	tokens = append(tokens, Token{Type: SourceToken, Value: line[start:], LineNo: lineNo, Column: start + 1})
+	return tokens
+}
+
+// Tokenize breaks a line into tokens using the operators registered
+// with the VirtualMachine, see SetIndented.
+func (vm *VirtualMachine) Tokenize(s string, lineNo int) []Token {
+	return tokenize(s, lineNo, vm.Ops, vm.indented)
+}
+
+// IsOperator reports if s starts with one of ops in leading position
+func IsOperator(s string, ops ...string) bool {
+	return leadingOp(s, ops) != ""
+}
+
+// isOperator is IsOperator, in indented mode s may be indented
+func (vm *VirtualMachine) isOperator(s string, ops ...string) bool {
+	if vm.indented {
+		s = s[skipSpace(s, 0):]
+	}
+	return IsOperator(s, ops...)
+}
+
+// isHeredocEnd reports if line ends a heredoc started with tag, in
+// indented mode the tag may be indented.
+func isHeredocEnd(line string, tag string, indented bool) bool {
+	if indented {
+		return strings.TrimSpace(line) == tag
+	}
+	return strings.TrimRight(line, "\r\n") == tag
+}
+
+// heredocTag returns TAG when source is in the form "<<TAG", otherwise
+// an empty string.
+func heredocTag(source string) string {
+	if strings.HasPrefix(source, "<<") && len(source) > 2 && strings.ContainsAny(source, " \t") == false {
+		return source[2:]
+	}
+	return ""
+}
+
+// heredocStart returns the heredoc TAG if tokens are an assignment or
+// comment that begins a heredoc, otherwise an empty string.
+func heredocStart(tokens []Token) string {
+	last := tokens[len(tokens)-1]
+	if (len(tokens) == 3 && last.Type == SourceToken) || last.Type == CommentToken {
+		return heredocTag(last.Value)
+	}
+	return ""
+}
+
+// parseHeredoc takes the lines following a heredoc assignment and
+// returns the body and the number of lines consumed including the
+// terminating TAG line. ok is false if the TAG line was not found.
+func parseHeredoc(lines []string, tag string, indented bool) (string, int, bool) {
+	for i, line := range lines {
+		if isHeredocEnd(line, tag, indented) {
+			return strings.Join(lines[:i], "\n"), i + 1, true
+		}
+	}
+	return strings.Join(lines, "\n"), len(lines), false
+}
+
+// formatAssignment returns the shorthand statement for a SourceMap. A
+// Source spanning more than one line is written as a heredoc.
+func formatAssignment(sm SourceMap) string {
+	if sm.Source == "" {
+		return fmt.Sprintf("%s %s", sm.Op, sm.Label)
+	}
+	if strings.Contains(sm.Source, "\n") == false {
+		return fmt.Sprintf("%s %s %s", sm.Op, sm.Label, sm.Source)
+	}
+	lines := strings.Split(sm.Source, "\n")
+	tag := "END"
+	for i := 1; ; i++ {
+		// The tag must not end the heredoc even when read in indented mode
+		if _, _, found := parseHeredoc(lines, tag, true); found == false {
+			break
+		}
+		tag = fmt.Sprintf("END%d", i)
+	}
+	return fmt.Sprintf("%s %s <<%s\n%s\n%s", sm.Op, sm.Label, tag, sm.Source, tag)
+}
+
+// statementReader reads statements one at a time. A statement is
+// normally a single line but a heredoc assignment, e.g.
+//
+//     :set: {{footer}} <<END
+//     <footer>...</footer>
+//     END
+//
+// is read as one statement spanning several lines.
+type statementReader struct {
+	vm       *VirtualMachine
+	readLine func() (string, error)
+	sep      string // joins the lines of a heredoc
+	lineNo   int
+}
+
+// newStatementReader returns a statementReader that reads lines,
+// including their line endings, from in.
+func newStatementReader(vm *VirtualMachine, in *bufio.Reader) *statementReader {
+	return &statementReader{
+		vm:  vm,
+		sep: "",
+		readLine: func() (string, error) {
+			line, err := in.ReadString('\n')
+			if err == io.EOF && line != "" {
+				return line, nil
+			}
+			return line, err
+		},
+	}
+}
+
+// newLinesReader returns a statementReader over lines that have already
+// been split, they do not include a line ending.
+func newLinesReader(vm *VirtualMachine, lines []string) *statementReader {
+	i := 0
+	return &statementReader{
+		vm:  vm,
+		sep: "\n",
+		readLine: func() (string, error) {
+			if i >= len(lines) {
+				return "", io.EOF
+			}
+			i++
+			return lines[i-1], nil
+		},
+	}
+}
+
+// newSplitReader returns a statementReader that reads lines from in the
+// same way strings.Split(text, "\n") would, line endings are removed
+// and text ending in a line ending is followed by an empty line.
+func newSplitReader(vm *VirtualMachine, in *bufio.Reader) *statementReader {
+	done := false
+	return &statementReader{
+		vm:  vm,
+		sep: "\n",
+		readLine: func() (string, error) {
+			if done {
+				return "", io.EOF
+			}
+			line, err := in.ReadString('\n')
+			if err == io.EOF {
+				done = true
+				return line, nil
+			}
+			if err != nil {
+				return "", err
+			}
+			return strings.TrimSuffix(line, "\n"), nil
+		},
+	}
+}
+
+// Next returns the next statement and the line number it starts on.
+// It returns io.EOF when there are no more statements.
+func (r *statementReader) Next() (string, int, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return "", r.lineNo, err
+	}
+	r.lineNo++
+	start := r.lineNo
+	tag := heredocStart(r.vm.Tokenize(line, start))
+	if tag == "" {
+		return line, start, nil
+	}
+	lines := []string{line}
+	for {
+		s, err := r.readLine()
+		if err == io.EOF {
+			return "", start, fmt.Errorf("heredoc <<%s starting at line %d is not terminated", tag, start)
+		}
+		if err != nil {
+			return "", start, err
+		}
+		r.lineNo++
+		lines = append(lines, s)
+		if isHeredocEnd(s, tag, r.vm.indented) {
+			break
+		}
+	}
+	return strings.Join(lines, r.sep), start, nil
+}
@@ -15,10 +15,10 @@
 package shorthand
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
-	"os"
-	"os/exec"
+	"io"
+	"strconv"
 	"strings"
 )
 
@@ -28,12 +28,19 @@ var AssignString = func(vm *VirtualMachine, sm SourceMap) (SourceMap, error) {
 	return SourceMap{Label: sm.Label, Op: sm.Op, Source: sm.Source, Expanded: expanded, LineNo: sm.LineNo}, nil
 }
 
+// Unset removes the label, it is an error if the label is not defined
+var Unset = func(vm *VirtualMachine, sm SourceMap) (SourceMap, error) {
+	if vm.Symbols.defined(sm.Label) == false {
+		return sm, fmt.Errorf("%s is not defined", sm.Label)
+	}
+	return SourceMap{Label: sm.Label, Op: UnsetOp, Source: "", Expanded: "", LineNo: sm.LineNo}, nil
+}
+
 //AssignInclude read a file using Source as filename and put the results in Expanded
 var AssignInclude = func(vm *VirtualMachine, sm SourceMap) (SourceMap, error) {
-	buf, err := ioutil.ReadFile(sm.Source)
+	_, buf, err := vm.importFile(sm.Source)
 	if err != nil {
-		return SourceMap{Label: "", Op: ":exit:", Source: "", Expanded: "", LineNo: sm.LineNo},
-			fmt.Errorf("Cannot read %s: %s\n", sm.Source, err)
+		return SourceMap{Label: "", Op: ":exit:", Source: "", Expanded: "", LineNo: sm.LineNo}, err
 	}
 	expanded := string(buf)
 	return SourceMap{Label: sm.Label, Op: sm.Op, Source: sm.Source, Expanded: expanded, LineNo: sm.LineNo}, nil
@@ -42,21 +49,63 @@ var AssignInclude = func(vm *VirtualMachine, sm SourceMap) (SourceMap, error) {
 // ImportAssignments evaluates the file for assignment operations
 var ImportAssignments = func(vm *VirtualMachine, sm SourceMap) (SourceMap, error) {
 	var output []string
-	buf, err := ioutil.ReadFile(sm.Source)
+	path, buf, err := vm.importFile(sm.Source)
 	if err != nil {
 		return SourceMap{Label: "", Op: ":exit:", Source: "", Expanded: "", LineNo: sm.LineNo}, err
 	}
-	lineNo := 1
-	for _, src := range strings.Split(string(buf), "\n") {
+	if err := vm.pushImport(vm.fullPath(path), sm.LineNo, sm.Column); err != nil {
+		return SourceMap{Label: "", Op: ":exit:", Source: "", Expanded: "", LineNo: sm.LineNo}, err
+	}
+	defer vm.popImport()
+	// Warnings and nested imports are relative to the imported file
+	fname, lineNo, source, column := vm.filename, vm.lineNo, vm.source, vm.column
+	defer func() {
+		vm.filename, vm.lineNo, vm.source, vm.column = fname, lineNo, source, column
+	}()
+	vm.filename = path
+	// Conditional sections end in the file that starts them
+	sections := vm.sections
+	vm.sections = nil
+	defer func() {
+		vm.sections = sections
+	}()
+
+	reader := newLinesReader(vm, strings.Split(string(buf), "\n"))
+	errs := ErrorList{}
+	for {
+		src, lineNo, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			err = &Error{SourceMap: SourceMap{Filename: path, LineNo: lineNo, Column: 1}, Err: err}
+			if vm.errorMode != CollectAll {
+				return SourceMap{Label: "", Op: ":exit:", Source: "", Expanded: "", LineNo: sm.LineNo}, err
+			}
+			errs.add(err)
+			break
+		}
+		// Errors are reported at their position in the imported file
 		s, err := vm.Eval(src, lineNo)
 		if err != nil {
-			return SourceMap{Label: "", Op: ":exit:", Source: "", Expanded: "", LineNo: sm.LineNo},
-				fmt.Errorf("ERROR (%s %d): %s", sm.Source, lineNo, err)
+			if vm.errorMode != CollectAll {
+				return SourceMap{Label: "", Op: ":exit:", Source: "", Expanded: "", LineNo: sm.LineNo}, err
+			}
+			errs.add(err)
 		}
 		if s != "" {
 			output = append(output, s)
 		}
 	}
+	if err := vm.closeSections(); err != nil {
+		if vm.errorMode != CollectAll {
+			return SourceMap{Label: "", Op: ":exit:", Source: "", Expanded: "", LineNo: sm.LineNo}, err
+		}
+		errs.add(err)
+	}
+	if len(errs) > 0 {
+		return SourceMap{Label: "", Op: ":exit:", Source: "", Expanded: "", LineNo: sm.LineNo}, errs
+	}
 	expanded := strings.Join(output, "\n")
 	return SourceMap{Label: sm.Label, Op: sm.Op, Source: sm.Source, Expanded: expanded, LineNo: sm.LineNo}, nil
 }
@@ -74,9 +123,18 @@ var AssignExpandExpansion = func(vm *VirtualMachine, sm SourceMap) (SourceMap, e
 	return SourceMap{Label: sm.Label, Op: sm.Op, Source: sm.Source, Expanded: expanded, LineNo: sm.LineNo}, nil
 }
 
+// AssignExpandRecursive expand Source until no labels are left and copy to Expanded
+var AssignExpandRecursive = func(vm *VirtualMachine, sm SourceMap) (SourceMap, error) {
+	expanded, err := vm.ExpandRecursive(sm.Source)
+	if err != nil {
+		return sm, err
+	}
+	return SourceMap{Label: sm.Label, Op: sm.Op, Source: sm.Source, Expanded: expanded, LineNo: sm.LineNo}, nil
+}
+
 // IncludeExpansion include the filename from Source, expand and copy to Expanded
 var IncludeExpansion = func(vm *VirtualMachine, sm SourceMap) (SourceMap, error) {
-	buf, err := ioutil.ReadFile(sm.Source)
+	_, buf, err := vm.importFile(sm.Source)
 	if err != nil {
 		return sm, err
 	}
@@ -84,23 +142,151 @@ var IncludeExpansion = func(vm *VirtualMachine, sm SourceMap) (SourceMap, error)
 	return SourceMap{Label: sm.Label, Op: sm.Op, Source: sm.Source, Expanded: expanded, LineNo: sm.LineNo}, nil
 }
 
-// AssignShell pass Source to bash and copy stdout to Expanded
+// runCommand runs cmd with the VM's Runner using the VM's context. If the VM has a
+// CommandTimeout the command is stopped when it runs longer. Errors are a *ShellError.
+func runCommand(vm *VirtualMachine, cmd Command) (Result, error) {
+	ctx := vm.Context()
+	if vm.CommandTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, vm.CommandTimeout)
+		defer cancel()
+	}
+	if vm.sandbox != nil {
+		if err := vm.sandbox.checkCommand(cmd.Line); err != nil {
+			return Result{}, &ShellError{Command: cmd.Line, Err: err}
+		}
+		if err := vm.sandbox.checkEnv(cmd.Env); err != nil {
+			return Result{}, &ShellError{Command: cmd.Line, Err: err}
+		}
+		cmd.Isolated = true
+	}
+	result, err := vm.Runner.Run(ctx, cmd)
+	if ctx.Err() == context.DeadlineExceeded && vm.Context().Err() == nil {
+		return Result{}, &ShellError{Command: cmd.Line, Err: fmt.Errorf("timed out after %s: %w", vm.CommandTimeout, ctx.Err())}
+	}
+	if ctx.Err() != nil {
+		return Result{}, &ShellError{Command: cmd.Line, Err: fmt.Errorf("stopped: %w", ctx.Err())}
+	}
+	if err != nil {
+		return result, &ShellError{Command: cmd.Line, Status: result.Status, Stderr: result.Stderr, Err: err}
+	}
+	return result, nil
+}
+
+// runShell runs cmd and returns its standard out. A command that fails
+// is an error holding its exit status and what it wrote to standard error.
+func runShell(vm *VirtualMachine, cmd Command) (string, error) {
+	result, err := runCommand(vm, cmd)
+	if err != nil {
+		return "", err
+	}
+	return result.Stdout, nil
+}
+
+// AssignShellCapture runs a command and assigns what it writes to
+// standard out to the label, standard error to a second label and the
+// exit status to a third. Source is in the form
+// "STDERR_LABEL STATUS_LABEL COMMAND". A command that fails is not an
+// error so the status can be checked.
+var AssignShellCapture = func(vm *VirtualMachine, sm SourceMap) (SourceMap, error) {
+	fields := strings.Fields(sm.Source)
+	if len(fields) < 3 {
+		return sm, fmt.Errorf("expected \"STDERR_LABEL STATUS_LABEL COMMAND\", got %q", sm.Source)
+	}
+	errLabel, statusLabel := fields[0], fields[1]
+	command := strings.TrimLeft(sm.Source, " \t")[len(errLabel):]
+	command = strings.TrimSpace(strings.TrimLeft(command, " \t")[len(statusLabel):])
+	// The stderr and status labels are stored as plain assignments so
+	// exported shorthand can be imported again
+	assigned := []SourceMap{
+		{Label: errLabel, Op: ":set:", Filename: sm.Filename, LineNo: sm.LineNo, Column: sm.Column, EndLineNo: sm.EndLineNo},
+		{Label: statusLabel, Op: ":set:", Filename: sm.Filename, LineNo: sm.LineNo, Column: sm.Column, EndLineNo: sm.EndLineNo},
+	}
+	// The command isn't run unless all three labels can be assigned
+	for _, label := range append(assigned, SourceMap{Label: sm.Label}) {
+		if err := vm.Symbols.checkAssign(label); err != nil {
+			return sm, err
+		}
+	}
+	result, err := runCommand(vm, Command{Line: command})
+	if err != nil && result.Status == 0 {
+		return sm, err
+	}
+	assigned[0].Source, assigned[0].Expanded = result.Stderr, result.Stderr
+	assigned[1].Source = strconv.Itoa(result.Status)
+	assigned[1].Expanded = assigned[1].Source
+	for _, label := range assigned {
+		vm.Symbols.SetSymbol(label)
+	}
+	return SourceMap{Label: sm.Label, Op: sm.Op, Source: sm.Source, Expanded: result.Stdout, LineNo: sm.LineNo}, nil
+}
+
+// AssignShell pass Source to the VM's Runner (bash by default) and copy stdout to Expanded
 var AssignShell = func(vm *VirtualMachine, sm SourceMap) (SourceMap, error) {
-	buf, err := exec.Command("bash", "-c", sm.Source).Output()
+	expanded, err := runShell(vm, Command{Line: sm.Source})
 	if err != nil {
 		return sm, err
 	}
-	expanded := string(buf)
 	return SourceMap{Label: sm.Label, Op: sm.Op, Source: sm.Source, Expanded: expanded, LineNo: sm.LineNo}, nil
 }
 
-// AssignExpandShell expand Source, pass to Bash and assign output to Expanded
+// AssignExpandShell expand Source, pass to the VM's Runner and assign output to Expanded
 var AssignExpandShell = func(vm *VirtualMachine, sm SourceMap) (SourceMap, error) {
-	buf, err := exec.Command("bash", "-c", vm.Expand(sm.Source)).Output()
+	expanded, err := runShell(vm, Command{Line: vm.Expand(sm.Source)})
+	if err != nil {
+		return sm, err
+	}
+	return SourceMap{Label: sm.Label, Op: sm.Op, Source: sm.Source, Expanded: expanded, LineNo: sm.LineNo}, nil
+}
+
+// AssignShellEnv runs a command with labels passed as environment variables
+// instead of being spliced into the command. Source is in the form
+// "[<STDIN_LABEL] [LABEL ...] -- COMMAND", each LABEL is exported as a
+// variable named after the label without its prefix and suffix
+// (e.g. {{pageTitle}} is $pageTitle) and the value of STDIN_LABEL is written
+// to the command's standard input. The command itself is not expanded.
+var AssignShellEnv = func(vm *VirtualMachine, sm SourceMap) (SourceMap, error) {
+	cmd := Command{}
+	rest := sm.Source
+	for {
+		rest = strings.TrimLeft(rest, " \t")
+		label := rest
+		if i := strings.IndexAny(rest, " \t"); i >= 0 {
+			label = rest[:i]
+		}
+		rest = rest[len(label):]
+		if label == "" {
+			return sm, fmt.Errorf("expected \"[<STDIN_LABEL] [LABEL ...] -- COMMAND\", got %q", sm.Source)
+		}
+		if label == "--" {
+			cmd.Line = strings.TrimSpace(rest)
+			break
+		}
+		stdin := strings.HasPrefix(label, "<")
+		if stdin {
+			label = label[1:]
+		}
+		if vm.Symbols.defined(label) == false {
+			return sm, fmt.Errorf("%s is not defined", label)
+		}
+		value := vm.Symbols.GetSymbol(label).Expanded
+		if stdin {
+			cmd.Stdin = value
+			continue
+		}
+		name, err := vm.labelSyntax.EnvName(label)
+		if err != nil {
+			return sm, err
+		}
+		cmd.Env = append(cmd.Env, name+"="+value)
+	}
+	if cmd.Line == "" {
+		return sm, fmt.Errorf("no command to run")
+	}
+	expanded, err := runShell(vm, cmd)
 	if err != nil {
 		return sm, err
 	}
-	expanded := string(buf)
 	return SourceMap{Label: sm.Label, Op: sm.Op, Source: sm.Source, Expanded: expanded, LineNo: sm.LineNo}, nil
 }
 
@@ -109,18 +295,18 @@ var OutputExpansion = func(vm *VirtualMachine, sm SourceMap) (SourceMap, error)
 	oSM := vm.Symbols.GetSymbol(sm.Label)
 	out := oSM.Expanded
 	fname := sm.Source
-	err := ioutil.WriteFile(fname, []byte(out), 0666)
+	err := vm.writeFile(fname, []byte(out))
 	if err != nil {
-		return sm, fmt.Errorf("%d Write error %s: %s", sm.LineNo, fname, err)
+		return sm, &IOError{Op: "write", Path: fname, Err: err}
 	}
 	return oSM, nil
 }
 
 // OutputExpansions write the expanded content out
 var OutputExpansions = func(vm *VirtualMachine, sm SourceMap) (SourceMap, error) {
-	fp, err := os.Create(sm.Source)
+	fp, err := vm.createFile(sm.Source)
 	if err != nil {
-		return sm, fmt.Errorf("%d Create error %s: %s", sm.LineNo, sm.Source, err)
+		return sm, &IOError{Op: "write", Path: sm.Source, Err: err}
 	}
 	defer fp.Close()
 	symbols := vm.Symbols.GetSymbols()
@@ -133,25 +319,188 @@ var OutputExpansions = func(vm *VirtualMachine, sm SourceMap) (SourceMap, error)
 // ExportAssignment write the assignment to a file
 var ExportAssignment = func(vm *VirtualMachine, sm SourceMap) (SourceMap, error) {
 	oSM := vm.Symbols.GetSymbol(sm.Label)
-	out := fmt.Sprintf("%s %s %s", oSM.Op, oSM.Label, oSM.Source)
+	out := formatAssignment(oSM)
 	fname := sm.Source
-	err := ioutil.WriteFile(fname, []byte(out), 0666)
+	err := vm.writeFile(fname, []byte(out))
 	if err != nil {
-		return sm, fmt.Errorf("%d Write error %s: %s", sm.LineNo, fname, err)
+		return sm, &IOError{Op: "write", Path: fname, Err: err}
 	}
 	return oSM, nil
 }
 
 // ExportAssignments write multiple assignments to a file
 var ExportAssignments = func(vm *VirtualMachine, sm SourceMap) (SourceMap, error) {
-	fp, err := os.Create(sm.Source)
+	fp, err := vm.createFile(sm.Source)
 	if err != nil {
-		return sm, fmt.Errorf("%d Create error %s: %s", sm.LineNo, sm.Source, err)
+		return sm, &IOError{Op: "write", Path: sm.Source, Err: err}
 	}
 	defer fp.Close()
 	symbols := vm.Symbols.GetSymbols()
 	for _, oSM := range symbols {
-		fmt.Fprintf(fp, "%s %s %s\n", oSM.Op, oSM.Label, oSM.Source)
+		fmt.Fprintln(fp, formatAssignment(oSM))
+	}
+	return sm, nil
+}
+
+// AssignHistory list each version of the label named in Source, one per line, and copy to Expanded
+var AssignHistory = func(vm *VirtualMachine, sm SourceMap) (SourceMap, error) {
+	lines := []string{}
+	for i, oSM := range vm.Symbols.GetHistory(sm.Source) {
+		lines = append(lines, fmt.Sprintf("%d (line %d): %s", i+1, oSM.LineNo, oSM.Expanded))
+	}
+	expanded := strings.Join(lines, "\n")
+	return SourceMap{Label: sm.Label, Op: sm.Op, Source: sm.Source, Expanded: expanded, LineNo: sm.LineNo}, nil
+}
+
+// AssignVersion copy the value of a prior version of a label to Expanded, Source is the label and version number
+var AssignVersion = func(vm *VirtualMachine, sm SourceMap) (SourceMap, error) {
+	parts := strings.Fields(sm.Source)
+	if len(parts) != 2 {
+		return sm, fmt.Errorf("expected a label and version, got %q", sm.Source)
+	}
+	version, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return sm, fmt.Errorf("version should be a number, got %q", parts[1])
+	}
+	oSM := vm.Symbols.GetSymbolVersion(parts[0], version)
+	if oSM.LineNo == -1 {
+		return sm, fmt.Errorf("%s has no version %d", parts[0], version)
+	}
+	return SourceMap{Label: sm.Label, Op: sm.Op, Source: sm.Source, Expanded: oSM.Expanded, LineNo: sm.LineNo}, nil
+}
+
+// ExportHistory write every assignment in parse order to a file
+var ExportHistory = func(vm *VirtualMachine, sm SourceMap) (SourceMap, error) {
+	fp, err := vm.createFile(sm.Source)
+	if err != nil {
+		return sm, &IOError{Op: "write", Path: sm.Source, Err: err}
+	}
+	defer fp.Close()
+	for _, oSM := range vm.Symbols.GetEntries() {
+		if oSM.Op != "" && oSM.Label != "" {
+			fmt.Fprintln(fp, formatAssignment(oSM))
+		}
+	}
+	return sm, nil
+}
+
+// ImportScoped evaluates the file named by the first word of Source in a new scope. The labels
+// listed after the filename are kept when the scope ends, the output is copied to Expanded
+var ImportScoped = func(vm *VirtualMachine, sm SourceMap) (SourceMap, error) {
+	parts := strings.Fields(sm.Source)
+	if len(parts) == 0 {
+		return sm, fmt.Errorf("expected a filename")
+	}
+	caller := vm.Symbols
+	vm.PushScope()
+	scope := vm.Symbols
+	defer func() {
+		vm.Symbols = caller
+	}()
+	// The filename starts Source so errors keep the position of the import
+	imported := sm
+	imported.Source = parts[0]
+	iSM, err := ImportAssignments(vm, imported)
+	if err != nil {
+		return iSM, err
+	}
+	if vm.Symbols != scope {
+		return sm, fmt.Errorf("%s did not end the scopes it started", parts[0])
+	}
+	if err := vm.PopScope(parts[1:]...); err != nil {
+		return sm, err
+	}
+	return SourceMap{Label: sm.Label, Op: sm.Op, Source: sm.Source, Expanded: iSM.Expanded, LineNo: sm.LineNo}, nil
+}
+
+// PushScope start a new scope for labels
+var PushScope = func(vm *VirtualMachine, sm SourceMap) (SourceMap, error) {
+	vm.PushScope()
+	return sm, nil
+}
+
+// PopScope end the current scope keeping the labels listed after the
+// operator, a label of "_" is a placeholder and is not kept
+var PopScope = func(vm *VirtualMachine, sm SourceMap) (SourceMap, error) {
+	exports := []string{}
+	for _, label := range strings.Fields(sm.Label + " " + sm.Source) {
+		if label != "_" {
+			exports = append(exports, label)
+		}
+	}
+	if err := vm.PopScope(exports...); err != nil {
+		return sm, err
 	}
 	return sm, nil
 }
+
+// isScopeOp reports if op starts or ends a scope, they don't make an assignment
+func isScopeOp(op string) bool {
+	return op == ":push-scope:" || op == ":pop-scope:"
+}
+
+// assignChoice expands the text before ":else:" in text when ok is true, otherwise the text after it
+func assignChoice(vm *VirtualMachine, sm SourceMap, ok bool, text string) SourceMap {
+	yes, no := cutElse(text)
+	expanded := no
+	if ok {
+		expanded = yes
+	}
+	return SourceMap{Label: sm.Label, Op: sm.Op, Source: sm.Source, Expanded: vm.Expand(expanded), LineNo: sm.LineNo}
+}
+
+// AssignIfDefined expand and assign the text after the label in Source if the label is defined, otherwise the text after :else:
+var AssignIfDefined = func(vm *VirtualMachine, sm SourceMap) (SourceMap, error) {
+	label, rest, err := cutWord(sm.Source)
+	if err != nil {
+		return sm, err
+	}
+	if label == "" {
+		return sm, fmt.Errorf("expected a label to test")
+	}
+	return assignChoice(vm, sm, vm.Symbols.defined(label), rest), nil
+}
+
+// AssignIfEmpty expand and assign the text after the label in Source if the label is empty or not defined, otherwise the text after :else:
+var AssignIfEmpty = func(vm *VirtualMachine, sm SourceMap) (SourceMap, error) {
+	label, rest, err := cutWord(sm.Source)
+	if err != nil {
+		return sm, err
+	}
+	if label == "" {
+		return sm, fmt.Errorf("expected a label to test")
+	}
+	return assignChoice(vm, sm, vm.isEmpty(label), rest), nil
+}
+
+// AssignIfEquals expand and assign the text after the label and value in Source if the label's value equals the value,
+// otherwise the text after :else:. A value containing spaces is quoted.
+var AssignIfEquals = func(vm *VirtualMachine, sm SourceMap) (SourceMap, error) {
+	label, rest, err := cutWord(sm.Source)
+	if err != nil {
+		return sm, err
+	}
+	if label == "" || rest == "" {
+		return sm, fmt.Errorf("expected a label and a value to compare")
+	}
+	value, rest, err := cutWord(rest)
+	if err != nil {
+		return sm, err
+	}
+	return assignChoice(vm, sm, vm.equals(label, value), rest), nil
+}
+
+// StartSection start a section of text that is only used when the test in Label and Source is true
+var StartSection = func(vm *VirtualMachine, sm SourceMap) (SourceMap, error) {
+	return sm, vm.startSection(sm)
+}
+
+// ElseSection start the part of a section used when its test is false
+var ElseSection = func(vm *VirtualMachine, sm SourceMap) (SourceMap, error) {
+	return sm, vm.elseSection(sm)
+}
+
+// EndSection end a conditional section
+var EndSection = func(vm *VirtualMachine, sm SourceMap) (SourceMap, error) {
+	return sm, vm.endSection(sm)
+}
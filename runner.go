@@ -0,0 +1,213 @@
+//
+// Package shorthand provides shorthand definition and expansion.
+//
+// runner.go - Runners execute the commands of the shell operators
+// (e.g. :bash:) so the shell can be chosen or replaced in tests.
+//
+// @author R. S. Doiel, <rsdoiel@gmail.com>
+// copyright (c) 2019 all rights reserved.
+// Released under the BSD 2-Clause license
+// See: http://opensource.org/licenses/BSD-2-Clause
+//
+package shorthand
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Command describes a command run by a shell operator
+type Command struct {
+	// Line is the command, e.g. "date +%Y"
+	Line string
+	// Env holds "NAME=value" pairs added to the environment
+	Env []string
+	// Stdin is written to the command's standard input
+	Stdin string
+	// Isolated commands are given only Env, they don't inherit the
+	// environment of shorthand
+	Isolated bool
+}
+
+// Result holds what a command wrote and its exit status
+type Result struct {
+	Stdout string
+	Stderr string
+	Status int
+}
+
+// Runner executes a command for the shell operators. A command that
+// exits with a non-zero status returns its Result along with an error.
+// The command should be stopped when ctx is done.
+type Runner interface {
+	Run(ctx context.Context, cmd Command) (Result, error)
+}
+
+// execCommand runs args with the environment and standard input of cmd
+func execCommand(ctx context.Context, cmd Command, args ...string) (Result, error) {
+	var stdout, stderr bytes.Buffer
+	c := exec.CommandContext(ctx, args[0], args[1:]...)
+	if cmd.Isolated {
+		c.Env = append([]string{}, cmd.Env...)
+	} else if len(cmd.Env) > 0 {
+		c.Env = append(os.Environ(), cmd.Env...)
+	}
+	c.Stdin = strings.NewReader(cmd.Stdin)
+	c.Stdout, c.Stderr = &stdout, &stderr
+	err := c.Run()
+	result := Result{Stdout: stdout.String(), Stderr: stderr.String()}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		result.Status = exitErr.ExitCode()
+	}
+	return result, err
+}
+
+// ShellRunner passes the command to a shell, e.g. bash -c COMMAND
+type ShellRunner struct {
+	Shell string
+	Args  []string
+}
+
+var (
+	// BashRunner runs commands with bash -c, it is the default Runner
+	BashRunner = &ShellRunner{Shell: "bash", Args: []string{"-c"}}
+
+	// ShRunner runs commands with sh -c
+	ShRunner = &ShellRunner{Shell: "sh", Args: []string{"-c"}}
+
+	// DirectRunner runs commands without a shell
+	DirectRunner = &ExecRunner{}
+)
+
+// Run passes the command to the shell
+func (r *ShellRunner) Run(ctx context.Context, cmd Command) (Result, error) {
+	args := append(append([]string{r.Shell}, r.Args...), cmd.Line)
+	return execCommand(ctx, cmd, args...)
+}
+
+// ExecRunner runs the command directly without a shell. The command
+// is split into arguments on spaces, single and double quotes group
+// words and a backslash escapes the next character. There are no
+// pipes, redirects or variables.
+type ExecRunner struct{}
+
+// Run splits the command into arguments and executes it
+func (r *ExecRunner) Run(ctx context.Context, cmd Command) (Result, error) {
+	args, err := SplitArgs(cmd.Line)
+	if err != nil {
+		return Result{}, err
+	}
+	if len(args) == 0 {
+		return Result{}, fmt.Errorf("no command to run")
+	}
+	return execCommand(ctx, cmd, args...)
+}
+
+// SplitArgs splits command into arguments the way ExecRunner does
+func SplitArgs(command string) ([]string, error) {
+	args := []string{}
+	var arg strings.Builder
+	inArg := false
+	quote := byte(0)
+	for i := 0; i < len(command); i++ {
+		c := command[i]
+		switch {
+		case c == '\\' && quote != '\'':
+			if i+1 >= len(command) {
+				return nil, fmt.Errorf("command %q ends with a backslash", command)
+			}
+			i++
+			arg.WriteByte(command[i])
+			inArg = true
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			arg.WriteByte(c)
+		case c == '\'' || c == '"':
+			quote = c
+			inArg = true
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteByte(c)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("command %q has an unterminated %c quote", command, quote)
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// FakeRunner is a Runner for tests. It records each command and returns
+// the result, output or error set for its Line without running anything.
+// A Result with a non-zero Status is returned with an error.
+type FakeRunner struct {
+	Results  map[string]Result
+	Outputs  map[string]string
+	Errors   map[string]error
+	Commands []Command
+
+	mu sync.Mutex
+}
+
+// NewFakeRunner returns a FakeRunner with no outputs
+func NewFakeRunner() *FakeRunner {
+	return &FakeRunner{Results: map[string]Result{}, Outputs: map[string]string{}, Errors: map[string]error{}}
+}
+
+// Run records command and returns its output. A command without an
+// output or an error is an error.
+func (r *FakeRunner) Run(ctx context.Context, cmd Command) (Result, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Commands = append(r.Commands, cmd)
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
+	if err, ok := r.Errors[cmd.Line]; ok {
+		return Result{}, err
+	}
+	if result, ok := r.Results[cmd.Line]; ok {
+		if result.Status != 0 {
+			return result, fmt.Errorf("exit status %d", result.Status)
+		}
+		return result, nil
+	}
+	if out, ok := r.Outputs[cmd.Line]; ok {
+		return Result{Stdout: out}, nil
+	}
+	return Result{}, fmt.Errorf("no output for %q", cmd.Line)
+}
+
+// ParseRunner returns the Runner for a shell name. "bash" and "sh" run
+// commands with that shell, "none" runs them without a shell and any
+// other value is used as the path to a shell that accepts -c.
+func ParseRunner(shell string) (Runner, error) {
+	switch shell {
+	case "", "bash":
+		return BashRunner, nil
+	case "sh":
+		return ShRunner, nil
+	case "none":
+		return DirectRunner, nil
+	}
+	if strings.ContainsAny(shell, " \t") {
+		return nil, fmt.Errorf("shell %q should be bash, sh, none or the path to a shell", shell)
+	}
+	return &ShellRunner{Shell: shell, Args: []string{"-c"}}, nil
+}
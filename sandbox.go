@@ -0,0 +1,155 @@
+//
+// Package shorthand provides shorthand definition and expansion.
+//
+// sandbox.go - Restricts the commands, files and writes available to
+// shorthand so templates from other people can be processed safely.
+//
+// @author R. S. Doiel, <rsdoiel@gmail.com>
+// copyright (c) 2019 all rights reserved.
+// Released under the BSD 2-Clause license
+// See: http://opensource.org/licenses/BSD-2-Clause
+//
+package shorthand
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// shellMetaChars are rejected in sandboxed commands so an allowed
+// command can not be used to start another
+const shellMetaChars = ";&|<>`$(){}[]*?~!#\r\n"
+
+// Sandbox restricts a VirtualMachine. Commands lists the commands the
+// shell operators may run, none when it is empty. Commands don't inherit
+// the environment, Env lists the variables (e.g. "pageTitle" for
+// {{pageTitle}}) they may be given, none when it is empty. When Root is
+// set files read and written must be inside it and relative filenames
+// are relative to it. ReadOnly stops operators from writing files.
+type Sandbox struct {
+	Commands []string
+	Env      []string
+	Root     string
+	ReadOnly bool
+}
+
+// NewSandboxed returns a VirtualMachine restricted by sb
+func NewSandboxed(sb Sandbox) *VirtualMachine {
+	vm := New()
+	vm.SetSandbox(&sb)
+	return vm
+}
+
+// SetSandbox restricts the VM, nil removes the restrictions
+func (vm *VirtualMachine) SetSandbox(sb *Sandbox) {
+	vm.sandbox = sb
+}
+
+// Sandbox returns the VM's restrictions, nil if there are none
+func (vm *VirtualMachine) Sandbox() *Sandbox {
+	return vm.sandbox
+}
+
+// checkCommand returns an error if the command is not allowed. A command
+// is allowed when its first word is in Commands and it does not use
+// the shell to run anything else.
+func (sb *Sandbox) checkCommand(line string) error {
+	if i := strings.IndexAny(line, shellMetaChars); i >= 0 {
+		return fmt.Errorf("%q is not allowed in sandboxed commands", line[i])
+	}
+	args, err := SplitArgs(line)
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		for _, name := range sb.Commands {
+			if args[0] == name {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s is not an allowed command", args[0])
+	}
+	return fmt.Errorf("no command to run")
+}
+
+// checkEnv returns an error if env sets a variable that is not in Env.
+// Only listed variables are passed so a label can't set one that changes
+// what the shell, the dynamic linker or the C library does.
+func (sb *Sandbox) checkEnv(env []string) error {
+	for _, kv := range env {
+		name := strings.SplitN(kv, "=", 2)[0]
+		allowed := false
+		for _, allow := range sb.Env {
+			if name == allow {
+				allowed = true
+				break
+			}
+		}
+		if allowed == false {
+			return fmt.Errorf("%s is not an allowed variable", name)
+		}
+	}
+	return nil
+}
+
+// realPath resolves the symbolic links in name, the parts of name that
+// do not exist yet are kept as they are.
+func realPath(name string) (string, error) {
+	rest := ""
+	for {
+		real, err := filepath.EvalSymlinks(name)
+		if err == nil {
+			return filepath.Join(real, rest), nil
+		}
+		if os.IsNotExist(err) == false {
+			return "", err
+		}
+		parent := filepath.Dir(name)
+		if parent == name {
+			return filepath.Join(name, rest), nil
+		}
+		rest = filepath.Join(filepath.Base(name), rest)
+		name = parent
+	}
+}
+
+// resolve returns the path of name inside Root, an error if the file
+// would be outside of it. Symbolic links are followed when onOS is true,
+// otherwise Root is a directory in an fs.FS and names are checked as
+// written.
+func (sb *Sandbox) resolve(name string, onOS bool) (string, error) {
+	if sb.Root == "" {
+		return name, nil
+	}
+	if onOS == false {
+		name = path.Clean(path.Join(sb.Root, filepath.ToSlash(name)))
+		root := path.Clean(sb.Root)
+		if strings.HasPrefix(filepath.ToSlash(name), "/") || (root != "." && name != root && strings.HasPrefix(name, root+"/") == false) || name == ".." || strings.HasPrefix(name, "../") {
+			return "", fmt.Errorf("%s is outside of %s", name, sb.Root)
+		}
+		return name, nil
+	}
+	root, err := filepath.Abs(sb.Root)
+	if err != nil {
+		return "", err
+	}
+	if filepath.IsAbs(name) == false {
+		name = filepath.Join(root, name)
+	}
+	realRoot, err := realPath(root)
+	if err != nil {
+		return "", err
+	}
+	real, err := realPath(filepath.Clean(name))
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(realRoot, real)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside of %s", name, sb.Root)
+	}
+	return name, nil
+}
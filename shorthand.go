@@ -13,9 +13,15 @@ package shorthand
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
+	"sort"
 	"strings"
+	"time"
 )
 
 // HowItWorks is a help text describing shorthand.
@@ -42,6 +48,10 @@ not written to stdout output.
 operator                    | meaning                                  | example
 ----------------------------|------------------------------------------|---------------------------------------------------------------------
  :set:                      | Assign String                            | :set: {{name}} Freda
+----------------------------|------------------------------------------|---------------------------------------------------------------------
+ :const:                    | Assign String that cannot be changed     | :const: {{site}} My Site
+----------------------------|------------------------------------------|---------------------------------------------------------------------
+ :unset:                    | Remove a label                           | :unset: {{name}}
 ----------------------------|------------------------------------------|---------------------------------------------------------------------
  :import-text:              | Assign the contents of a file            | :import-text: {{content}} myfile.txt
 ----------------------------|------------------------------------------|---------------------------------------------------------------------
@@ -52,10 +62,23 @@ operator                    | meaning                                  | example
  :expand-expansion:         | Assign expanded expansion                | :expand-expansion: {{reportHeading}} @reportTitle
 ----------------------------|------------------------------------------|---------------------------------------------------------------------
  :import:                   | Include a file, procesisng the shorthand | :import: {{nav}} mynav.shorthand
+----------------------------|------------------------------------------|---------------------------------------------------------------------
+ :import-scoped:            | Get assignments from a file in a new     | :import-scoped: _ nav.shorthand {{nav}} {{title}}
+                            | scope, keep the labels listed            |
+----------------------------|------------------------------------------|---------------------------------------------------------------------
+ :push-scope:               | Start a new scope for labels             | :push-scope: _
+----------------------------|------------------------------------------|---------------------------------------------------------------------
+ :pop-scope:                | End a scope, keep the labels listed      | :pop-scope: _ {{nav}} {{title}}
+----------------------------|------------------------------------------|---------------------------------------------------------------------
+ :expand-recursive:         | Expand until no labels are left          | :expand-recursive: {{page}} {{header}}{{body}}{{footer}}
 ----------------------------|------------------------------------------|---------------------------------------------------------------------
  :bash:                     | Assign Shell output                      | :bash: {{date}} date +%Y-%m-%%d
 ----------------------------|------------------------------------------|---------------------------------------------------------------------
  :expand-and-bash:          | Assign Expand then gete Shell output     | :expand-and-bash: {{entry}} cat header.txt @filename footer.txt
+----------------------------|------------------------------------------|---------------------------------------------------------------------
+ :bash-env:                 | Assign Shell output, labels as variables | :bash-env: {{words}} <{{body}} {{title}} -- wc -w
+----------------------------|------------------------------------------|---------------------------------------------------------------------
+ :bash-capture:             | Assign Shell output, errors and status   | :bash-capture: {{out}} {{err}} {{status}} make site
 ----------------------------|------------------------------------------|---------------------------------------------------------------------
  :export:                   | Output a label's value to a file         | :export: {{content}} content.txt
 ----------------------------|------------------------------------------|---------------------------------------------------------------------
@@ -64,16 +87,155 @@ operator                    | meaning                                  | example
  :export-shorthand:             | Output Assignment                        | :export-shorthand: {{content}} content.shorthand
 ----------------------------|------------------------------------------|---------------------------------------------------------------------
  :export-all-shorthand:        | Output all shorthand assignments      | :export-all-shorthand: _ contents.shorthand
+----------------------------|------------------------------------------|---------------------------------------------------------------------
+ :history:                  | Assign a label's prior values            | :history: {{titles}} {{title}}
+----------------------------|------------------------------------------|---------------------------------------------------------------------
+ :expand-version:           | Assign a prior version of a label        | :expand-version: {{firstTitle}} {{title}} 1
+----------------------------|------------------------------------------|---------------------------------------------------------------------
+ :export-history:           | Output every assignment in parse order   | :export-history: _ history.shorthand
+----------------------------|------------------------------------------|---------------------------------------------------------------------
+ :if-defined:               | Assign a value if a label is defined,    | :if-defined: {{hi}} {{name}} Hello {{name}} :else: Hello
+                            | the value after :else: if not            |
+----------------------------|------------------------------------------|---------------------------------------------------------------------
+ :if-empty:                 | Assign a value if a label is empty       | :if-empty: {{navClass}} {{nav}} hidden :else: shown
+----------------------------|------------------------------------------|---------------------------------------------------------------------
+ :if-equals:                | Assign a value if a label equals a       | :if-equals: {{class}} {{page}} "About us" active :else: inactive
+                            | string                                   |
+----------------------------|------------------------------------------|---------------------------------------------------------------------
+ :if:, :else:, :end-if:     | Use a section of text only when a test   | :if: not empty {{nav}}
+                            | is true                                  |
 ----------------------------|------------------------------------------|---------------------------------------------------------------------
  :exit:                     | Exit the shorthand repl                  | :exit:
 ----------------------------|------------------------------------------|---------------------------------------------------------------------
+ :comment:                  | A comment, dropped from the output       | :comment: build the blog index
+----------------------------|------------------------------------------|---------------------------------------------------------------------
+
+
+
+Notes: Using an underscore as a LABEL means the label will be ignored. ":export-all:" and ":export-all-shorthand:" write labels in the
+order they were last assigned, labels from enclosing scopes first, so the same input always writes the same file.
+
+Each assignment to a label is kept. Versions of a label are numbered from 1 in the order they were assigned, 0 is the current
+version and -1 the one before it.
+
+The spaces following surrounding ":set:", ":import-text:", ":bash:", ":expand:", ":export:", etc. are required. An operator
+is only recognized at the start of a line, a line that mentions an operator elsewhere is treated as text and expanded.
+With the -indented option a statement may also be indented with spaces or tabs so shorthand can be written in a literate
+style, e.g. as markdown code blocks.
+
+
+MULTI-LINE ASSIGNMENTS
+
+An assignment can span several lines using a heredoc. When the value of an assignment is "<<" followed by a tag the 
+lines that follow, up to a line containing only the tag, are the value.
+
+    :set: {{footer}} <<END
+    <footer>
+      <span>{{copyright}}</span>
+    </footer>
+    END
+
+Heredocs are supported by every operator and in files read with ":import-shorthand:".
+
+
+CONDITIONALS
+
+":if-defined:", ":if-empty:" and ":if-equals:" assign the text following the label being tested when the test is true and
+the text following ":else:" when it is false, the chosen text is expanded. A label is empty when it is not defined or its
+value is only white space. The value given to ":if-equals:" is quoted when it contains spaces.
+
+    :if-empty: {{navClass}} {{nav}} hidden :else: shown
+    :if-equals: {{class}} {{page}} "About us" active :else: inactive
+
+Lines between ":if:" and ":end-if:" are only used when the test is true, the lines after an ":else:" when it is false.
+The test is "defined LABEL", "empty LABEL" or "equals LABEL VALUE" and can start with "not". Sections can be nested, they
+must end in the file they start in. The statements in a section that isn't used are not evaluated.
+
+    :if: not empty {{nav}}
+    <nav>{{nav}}</nav>
+    :else:
+    <p><a href="index.html">Home</a></p>
+    :end-if:
+
+
+IMPORTS
+
+A relative filename given to ":import:", ":import-text:", ":import-shorthand:" or ":import-scoped:" is looked for next
+to the file containing the import, then in the working directory and then in each directory of the search path. The
+search path is set with the -I option and the SHORTHAND_PATH environment variable, directories are separated by ":"
+(";" on Windows). Errors reading a file include its full path. A file that imports itself, directly or through other
+files, is an error listing the chain of imports. Imports can be nested 32 deep.
+
+
+ERRORS
+
+Errors are written as "file:line:col: message" so editors can jump to them. An error in an imported file points into
+that file. Shorthand read from standard input is named "<input>". Warnings from -strict and the chain of files in an
+import cycle use the same format.
+
+    site/nav.shorthand:4:18: {{title}} has no version 3
+    site/page.shorthand:2:5: warning: {{pageTitel}} is not defined
+
+By default each error is reported and processing continues with the next line. With -fail-fast processing stops at the
+first error. With -collect-errors every error is reported, including each error in an imported file rather than only
+the first, so one pass over a site finds all the broken imports and commands. Both exit with an error if any were found.
+
+    shorthand -I partials:/usr/local/share/shorthand site/index.shorthand
+
+
+COMMENTS
+
+A line starting with ":comment:" is dropped from the output. A block comment is written as a heredoc.
+
+    :comment: Build the index page
+    :comment: <<END
+    Everything up to the END line is
+    a comment too.
+    END
+
+
+ESCAPES
+
+A backslash before a label or before an operator at the start of a line writes it literally. This is how documentation about
+shorthand can be written in shorthand.
+
+    \:set: \{{pageTitle}} My Page
+
+outputs ":set: {{pageTitle}} My Page" without making an assignment or expanding {{pageTitle}}. Use two backslashes to write a
+backslash followed by the label's value.
+
+
+SHELL COMMANDS
 
+":bash:" and ":expand-and-bash:" run their command with bash by default. The command line option -shell picks another
+shell, "sh" or the path to a shell that accepts -c, or "none" to run the command directly without a shell. Without a
+shell the command is split into words on spaces, quotes group words and there are no pipes, redirects or variables.
 
+":expand-and-bash:" splices label values into the command which breaks on quotes and lets a label's value run as a command.
+":bash-env:" passes labels to the command as environment variables instead, named after the label without its braces. A
+label starting with "<" is written to the command's standard input. The labels are listed before "--" and the command
+after it is not expanded.
 
-Notes: Using an underscore as a LABEL means the label will be ignored. There are no guarantees of order when writing values or assignment 
-statements to a file.
+    :import-text: {{body}} post.txt
+    :set: {{title}} Tom's "quoted" post
+    :bash-env: {{summary}} <{{body}} {{title}} -- echo "$title: $(wc -w) words"
 
-The spaces following surrounding ":set:", ":import-text:", ":bash:", ":expand:", ":export:", etc. are required.
+A command that fails is an error that includes its exit status and what it wrote to standard error. ":bash-capture:"
+assigns the output, the error output and the exit status to three labels instead so the status can be checked.
+
+    :bash-capture: {{out}} {{err}} {{status}} make site
+
+
+SAFE MODE
+
+Shorthand from other people should be processed with the -safe option. Commands are not run unless they are listed
+with -allow-commands, a command may not use the shell to run another (e.g. with ";", "|" or "$(...)"). Commands don't
+inherit the environment and ":bash-env:" can only pass the variables listed with -allow-env, so a label can't set a
+variable like BASH_ENV, PATH or LD_PRELOAD that changes what is run. Files that
+are read or written must be inside the directory given by -root, the current directory by default. The -read-only
+option stops ":export:" and the other export operators from writing files.
+
+    shorthand -safe -allow-commands date,wc -allow-env pageTitle -read-only page.shorthand
 
 
 EXAMPLE
@@ -161,41 +323,181 @@ Then we can run the following command to pipe it through Pandoc.
 `
 )
 
+const (
+	// ConstOp assigns a string to a label that cannot be assigned again
+	ConstOp = ":const:"
+
+	// UnsetOp removes a label
+	UnsetOp = ":unset:"
+
+	// DefaultMaxDepth is the default for VirtualMachine.MaxDepth
+	DefaultMaxDepth = 100
+
+	// DefaultMaxExpansionSize is the default for VirtualMachine.MaxExpansionSize (16 MiB)
+	DefaultMaxExpansionSize = 16 << 20
+
+	// DefaultMaxIncludeDepth is the default for VirtualMachine.MaxIncludeDepth
+	DefaultMaxIncludeDepth = 32
+)
+
+// ErrorMode chooses what happens when a statement fails
+type ErrorMode int
+
+const (
+	// DefaultErrors stops Apply and ApplyStream at the first error, Run
+	// reports each error and continues
+	DefaultErrors ErrorMode = iota
+	// FailFast stops at the first error
+	FailFast
+	// CollectAll continues after an error, the errors are returned
+	// together as an ErrorList
+	CollectAll
+)
+
 // SourceMap holds the source and value of an assignment
 type SourceMap struct {
-	Label    string // Label is the symbol to be replace based on Op and Source
-	Op       string // Op is the type of assignment being made (if is an empty string if not an assignment)
-	Source   string // Source is argument to the right of Op
-	Expanded string // Expanded is the value calculated based on Label, Op and Source
-	LineNo   int
+	Label     string // Label is the symbol to be replace based on Op and Source
+	Op        string // Op is the type of assignment being made (if is an empty string if not an assignment)
+	Source    string // Source is argument to the right of Op
+	Expanded  string // Expanded is the value calculated based on Label, Op and Source
+	Filename  string // Filename is the file the assignment was read from, empty if there isn't one
+	LineNo    int    // LineNo is the line the assignment starts on
+	Column    int    // Column is the one based column Source starts at
+	EndLineNo int    // EndLineNo is the line the assignment ends on (e.g. the end of a heredoc)
+}
+
+// Position returns where the SourceMap was read as file:line:col. Shorthand
+// that isn't read from a file is shown as "<input>".
+func (sm SourceMap) Position() string {
+	fname := sm.Filename
+	if fname == "" {
+		fname = "<input>"
+	}
+	return fmt.Sprintf("%s:%d:%d", fname, sm.LineNo, sm.Column)
 }
 
 // SymbolTable holds the exressions, values and other errata of parsing assignments making expansions
 type SymbolTable struct {
 	entries []SourceMap
 	labels  map[string]int
+	version int // incremented each time the table changes
+
+	// parent is the enclosing scope, labels not found in this table
+	// are looked up in the parent.
+	parent *SymbolTable
+}
+
+// NewChild returns a new, empty, SymbolTable scoped inside st. Labels
+// assigned in the child do not change st but labels in st can be
+// read through the child.
+func (st *SymbolTable) NewChild() *SymbolTable {
+	return &SymbolTable{parent: st}
+}
+
+// Parent returns the enclosing scope or nil for the outer most scope
+func (st *SymbolTable) Parent() *SymbolTable {
+	return st.parent
+}
+
+// generation changes whenever st or one of its parents changes
+func (st *SymbolTable) generation() int {
+	g := 0
+	for t := st; t != nil; t = t.parent {
+		g += t.version
+	}
+	return g
 }
 
 // GetSymbol finds the symbol entry and returns the SourceMap
 func (st *SymbolTable) GetSymbol(sym string) SourceMap {
 	i, ok := st.labels[sym]
-	if ok == true {
+	if ok == true && i >= 0 {
 		return st.entries[i]
 	}
-	return SourceMap{Label: "", Op: "", Source: "", Expanded: "", LineNo: -1}
+	if ok == true {
+		return SourceMap{Label: "", Op: "", Source: "", Expanded: "", LineNo: -1, EndLineNo: -1}
+	}
+	if st.parent != nil {
+		return st.parent.GetSymbol(sym)
+	}
+	return SourceMap{Label: "", Op: "", Source: "", Expanded: "", LineNo: -1, EndLineNo: -1}
 }
 
-// GetSymbols returns a list of all symbols defined by labels as an array of SourceMaps
+// defined reports if a label has been assigned in this scope or an enclosing one
+func (st *SymbolTable) defined(sym string) bool {
+	if i, ok := st.labels[sym]; ok {
+		return i >= 0
+	}
+	return st.parent != nil && st.parent.defined(sym)
+}
+
+// GetSymbols returns a list of all symbols defined by labels as an array of SourceMaps.
+// The list is ordered by when each label was last assigned, labels from
+// enclosing scopes come first.
 func (st *SymbolTable) GetSymbols() []SourceMap {
 	var symbols []SourceMap
 
+	if st.parent != nil {
+		for _, sm := range st.parent.GetSymbols() {
+			if _, ok := st.labels[sm.Label]; ok == false {
+				symbols = append(symbols, sm)
+			}
+		}
+	}
+	indexes := make([]int, 0, len(st.labels))
 	for _, i := range st.labels {
+		if i >= 0 {
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Ints(indexes)
+	for _, i := range indexes {
 		symbols = append(symbols, st.entries[i])
 	}
 	return symbols
 }
 
+// GetHistory returns every assignment made to a label in parse order,
+// the last one is the current value. Assignments made in enclosing
+// scopes come first.
+func (st *SymbolTable) GetHistory(sym string) []SourceMap {
+	history := []SourceMap{}
+	if st.parent != nil {
+		history = st.parent.GetHistory(sym)
+	}
+	for _, sm := range st.entries {
+		if sm.Label == sym {
+			history = append(history, sm)
+		}
+	}
+	return history
+}
+
+// GetSymbolVersion returns a prior assignment of a label. Versions are
+// numbered from one in parse order, zero is the current version and a
+// negative version counts back from it (e.g. -1 is the previous version).
+// If the version does not exist a SourceMap with LineNo -1 is returned.
+func (st *SymbolTable) GetSymbolVersion(sym string, version int) SourceMap {
+	history := st.GetHistory(sym)
+	if version <= 0 {
+		version += len(history)
+	}
+	if version < 1 || version > len(history) {
+		return SourceMap{Label: "", Op: "", Source: "", Expanded: "", LineNo: -1, EndLineNo: -1}
+	}
+	return history[version-1]
+}
+
+// GetEntries returns the full log of assignments made in this scope in
+// parse order. Replaying it shows how each label's value evolved.
+func (st *SymbolTable) GetEntries() []SourceMap {
+	entries := make([]SourceMap, len(st.entries))
+	copy(entries, st.entries)
+	return entries
+}
+
 // SetSymbol adds a SourceMap to entries and points the labels at the most recent definition.
+// An assignment using UnsetOp removes the label.
 func (st *SymbolTable) SetSymbol(sm SourceMap) int {
 	st.entries = append(st.entries, sm)
 	if st.labels == nil {
@@ -203,7 +505,35 @@ func (st *SymbolTable) SetSymbol(sm SourceMap) int {
 	}
 	i := len(st.entries) - 1
 	st.labels[sm.Label] = i
-	return st.labels[sm.Label]
+	if sm.Op == UnsetOp {
+		// -1 hides the label in this scope and any enclosing one
+		st.labels[sm.Label] = -1
+	}
+	st.version++
+	return i
+}
+
+// UnsetSymbol removes a label, the removal is recorded in the history.
+// Returns false if the label was not defined.
+func (st *SymbolTable) UnsetSymbol(sym string) bool {
+	if st.defined(sym) == false {
+		return false
+	}
+	st.SetSymbol(SourceMap{Label: sym, Op: UnsetOp, Source: "", Expanded: ""})
+	return true
+}
+
+// IsConstant reports if a label was assigned with ConstOp
+func (st *SymbolTable) IsConstant(sym string) bool {
+	return st.defined(sym) && st.GetSymbol(sym).Op == ConstOp
+}
+
+// checkAssign returns an error if the label in sm is a constant
+func (st *SymbolTable) checkAssign(sm SourceMap) error {
+	if st.IsConstant(sm.Label) {
+		return fmt.Errorf("%s is a constant defined at line %d", sm.Label, st.GetSymbol(sm.Label).LineNo)
+	}
+	return nil
 }
 
 // OperatorMap is a map of operator testings and their related functions
@@ -217,6 +547,87 @@ type VirtualMachine struct {
 	Operators OperatorMap
 	Ops       []string
 	Help      map[string]string
+
+	// In is read by Run when it isn't passed a reader, Out receives
+	// prompts and output and Eout receives errors and warnings. New
+	// sets them to os.Stdin, os.Stdout and os.Stderr.
+	In   io.Reader
+	Out  io.Writer
+	Eout io.Writer
+
+	// Warnings holds the labels strict mode found used but not assigned
+	Warnings []Warning
+
+	// Errors holds the errors Run found when the ErrorMode is FailFast
+	// or CollectAll
+	Errors ErrorList
+
+	// ReadFS is where operators read files from and WriteFS where they
+	// write them, both are OSFileSystem by default. ReadFS can be an
+	// embed.FS or MemFS.
+	ReadFS  fs.FS
+	WriteFS WriteFS
+
+	// IncludePath lists directories searched for imported files that
+	// are not found next to the importing file or the working directory.
+	IncludePath []string
+
+	// Runner executes the commands of the shell operators, BashRunner
+	// by default.
+	Runner Runner
+
+	// CommandTimeout limits how long each shell operator (e.g. :bash:)
+	// can run, zero means no limit.
+	CommandTimeout time.Duration
+
+	// MaxDepth limits how deeply ExpandRecursive follows labels
+	// defined in terms of other labels, zero means no limit.
+	MaxDepth int
+	// MaxExpansionSize limits the size in bytes of the text
+	// returned by ExpandRecursive, zero means no limit.
+	MaxExpansionSize int
+	// MaxIncludeDepth limits how deeply files imported with
+	// :import-shorthand: can import other files, zero means no limit.
+	MaxIncludeDepth int
+
+	// expander caches the automaton used by Expand
+	expander        *expander
+	expanderTable   *SymbolTable
+	expanderVersion int
+
+	// sandbox restricts commands and files when it is not nil
+	sandbox *Sandbox
+
+	// ctx is passed to shell operators, when it is done Run and
+	// ApplyStream stop.
+	ctx context.Context
+
+	// recursive mode expands text to a fixed point, see ExpandRecursive
+	recursive bool
+
+	// indented mode recognizes operators after leading spaces and tabs
+	indented bool
+
+	// errorMode chooses between stopping or continuing after an error
+	errorMode ErrorMode
+
+	// strict mode reports labels written in labelSyntax that are not defined
+	strict      bool
+	labelSyntax LabelSyntax
+	warned      map[Warning]bool
+
+	// filename and lineNo are the position of the statement being
+	// evaluated, source is its Source which starts at column
+	filename string
+	lineNo   int
+	source   string
+	column   int
+
+	// imports are the files being imported, innermost last
+	imports []importFrame
+
+	// sections are the conditional sections being evaluated, innermost last
+	sections []section
 }
 
 // New returns a VirtualMachine struct and registers all Operators
@@ -225,33 +636,156 @@ func New() *VirtualMachine {
 	vm.Symbols = new(SymbolTable)
 	vm.Operators = make(OperatorMap)
 	vm.Help = make(map[string]string)
+	vm.In, vm.Out, vm.Eout = os.Stdin, os.Stdout, os.Stderr
+	vm.ctx = context.Background()
+	vm.Runner = BashRunner
+	vm.ReadFS, vm.WriteFS = OSFileSystem{}, OSFileSystem{}
+	vm.labelSyntax = CurlyBraces
+	vm.MaxDepth = DefaultMaxDepth
+	vm.MaxExpansionSize = DefaultMaxExpansionSize
+	vm.MaxIncludeDepth = DefaultMaxIncludeDepth
 
 	// Register the built-in operators (readable versions)
 	vm.RegisterOp(":set:", AssignString, "Assign a string to label")
+	vm.RegisterOp(ConstOp, AssignString, "Assign a string to a label that cannot be changed")
+	vm.RegisterOp(UnsetOp, Unset, "Remove a label")
 	vm.RegisterOp(":import-text:", AssignInclude, "Include content and assign to label")
 	vm.RegisterOp(":import-shorthand:", ImportAssignments, "Import assignments from a shorthand file")
 
 	vm.RegisterOp(":expand:", AssignExpansion, "Expand and assign to label")
 	vm.RegisterOp(":expand-expansion:", AssignExpandExpansion, "Expand and expansion and assign to label")
 	vm.RegisterOp(":import:", IncludeExpansion, "Include a file, evaluate the shorthand")
+	vm.RegisterOp(":expand-recursive:", AssignExpandRecursive, "Expand until no labels are left and assign to label")
 
 	vm.RegisterOp(":bash:", AssignShell, "Assign the output of a Bash command to label")
 	vm.RegisterOp(":expand-and-bash:", AssignExpandShell, "Expand and then assign the results of a Bash command to label")
+	vm.RegisterOp(":bash-env:", AssignShellEnv, "Assign the output of a command run with labels as environment variables")
+	vm.RegisterOp(":bash-capture:", AssignShellCapture, "Assign the output, error output and exit status of a Bash command to labels")
 
 	vm.RegisterOp(":export:", OutputExpansion, "Write an the contents of an label to a file")
-	vm.RegisterOp(":export-all:", OutputExpansions, "Write all label contents to a (order not guaranteed)")
+	vm.RegisterOp(":export-all:", OutputExpansions, "Write all label contents to a file in the order they were last assigned")
+
+	vm.RegisterOp(":import-scoped:", ImportScoped, "Import assignments from a shorthand file in a new scope, keeping the labels listed after the filename")
+	vm.RegisterOp(":push-scope:", PushScope, "Start a new scope for labels")
+	vm.RegisterOp(":pop-scope:", PopScope, "End a scope, keeping the labels listed")
 
 	vm.RegisterOp(":export-shorthand:", ExportAssignment, "Export assignment to a file")
-	vm.RegisterOp(":export-all-shorthand:", ExportAssignments, "Expand all assignments (order not guaranteed)")
+	vm.RegisterOp(":export-all-shorthand:", ExportAssignments, "Export all assignments to a file in the order they were last assigned")
+
+	vm.RegisterOp(":history:", AssignHistory, "Assign the list of a label's prior values to label")
+	vm.RegisterOp(":expand-version:", AssignVersion, "Assign a prior version of a label to label")
+	vm.RegisterOp(":export-history:", ExportHistory, "Export every assignment in parse order to a file")
+
+	vm.RegisterOp(":if-defined:", AssignIfDefined, "Assign one value if a label is defined, another after :else: if not")
+	vm.RegisterOp(":if-empty:", AssignIfEmpty, "Assign one value if a label is empty or not defined, another after :else: if not")
+	vm.RegisterOp(":if-equals:", AssignIfEquals, "Assign one value if a label equals a string, another after :else: if not")
+	vm.RegisterOp(IfOp, StartSection, "Start a section of text used when a test (defined, empty or equals) is true")
+	vm.RegisterOp(ElseOp, ElseSection, "Start the part of a section used when the test is false")
+	vm.RegisterOp(EndIfOp, EndSection, "End a conditional section")
 
 	return vm
 }
 
+// PushScope starts a new scope, labels assigned until PopScope is called
+// are kept in a child of the current SymbolTable.
+func (vm *VirtualMachine) PushScope() {
+	vm.Symbols = vm.Symbols.NewChild()
+}
+
+// PopScope ends the current scope and returns to the enclosing one. The
+// current values of the labels listed in exports are assigned in the
+// enclosing scope, all other labels assigned in the scope are dropped.
+func (vm *VirtualMachine) PopScope(exports ...string) error {
+	parent := vm.Symbols.Parent()
+	if parent == nil {
+		return fmt.Errorf("no scope to pop")
+	}
+	for _, label := range exports {
+		if vm.Symbols.defined(label) == false {
+			return fmt.Errorf("cannot export %s from scope, it is not defined", label)
+		}
+		if err := parent.checkAssign(SourceMap{Label: label}); err != nil {
+			return err
+		}
+	}
+	for _, label := range exports {
+		parent.SetSymbol(vm.Symbols.GetSymbol(label))
+	}
+	vm.Symbols = parent
+	return nil
+}
+
 // SetPrompt sets the string value of the prompt for a VirtualMachine instance
 func (vm *VirtualMachine) SetPrompt(s string) {
 	vm.prompt = s
 }
 
+// SetLabelSyntax sets how labels are written, it is used by strict mode
+// to find labels that have not been assigned.
+func (vm *VirtualMachine) SetLabelSyntax(ls LabelSyntax) {
+	vm.labelSyntax = ls
+}
+
+// SetContext sets the context passed to shell operators. Use a context
+// with a deadline to limit how long a whole run can take.
+func (vm *VirtualMachine) SetContext(ctx context.Context) {
+	vm.ctx = ctx
+}
+
+// Context returns the context operators should use for long running work
+func (vm *VirtualMachine) Context() context.Context {
+	if vm.ctx == nil {
+		return context.Background()
+	}
+	return vm.ctx
+}
+
+// SetRecursive turns recursive mode on or off. In recursive mode text
+// that is not an assignment is expanded with ExpandRecursive.
+func (vm *VirtualMachine) SetRecursive(on bool) {
+	vm.recursive = on
+}
+
+// SetIndented turns indented mode on or off. In indented mode a
+// statement may be indented with spaces or tabs so shorthand can be
+// written in a literate style, e.g. as markdown code blocks.
+func (vm *VirtualMachine) SetIndented(on bool) {
+	vm.indented = on
+}
+
+// SetStrict turns strict mode on or off. In strict mode each label found
+// by Expand that has not been assigned is added to Warnings.
+func (vm *VirtualMachine) SetStrict(on bool) {
+	vm.strict = on
+}
+
+// SetErrorMode chooses between stopping at the first error (FailFast)
+// and continuing and collecting every error (CollectAll)
+func (vm *VirtualMachine) SetErrorMode(mode ErrorMode) {
+	vm.errorMode = mode
+}
+
+// SetFilename sets the name of the file being processed, it is used
+// when reporting warnings.
+func (vm *VirtualMachine) SetFilename(fname string) {
+	vm.filename = fname
+}
+
+// warn records a Warning for a label at column of the current line, a
+// label is only reported once for each line.
+func (vm *VirtualMachine) warn(label string, column int) {
+	w := Warning{Filename: vm.filename, LineNo: vm.lineNo, Label: label}
+	if vm.warned == nil {
+		vm.warned = make(map[Warning]bool)
+	}
+	if vm.warned[w] {
+		return
+	}
+	vm.warned[w] = true
+	w.Column = column
+	vm.Warnings = append(vm.Warnings, w)
+}
+
 // RegisterOp associate a operation and function
 func (vm *VirtualMachine) RegisterOp(op string, callback func(*VirtualMachine, SourceMap) (SourceMap, error), help string) error {
 	_, ok := vm.Operators[op]
@@ -265,63 +799,170 @@ func (vm *VirtualMachine) RegisterOp(op string, callback func(*VirtualMachine, S
 }
 
 // Parse a string, return a source map. Takes advantage of the internal ops list.
+// Operators are only recognized at the start of the line (see Tokenize).
 // If no valid op is found then return a source map with Label and Op set to an empty string
 // while Source is set the the string that was parsed.  Expanded should always be an empty string
 // at the parse stage.
+//
+// An assignment whose source is "<<TAG" is a heredoc, the lines that follow in s up
+// to a line containing only TAG become the Source and EndLineNo is set to the line
+// number of TAG.
 func (vm *VirtualMachine) Parse(s string, lineNo int) SourceMap {
-	for _, op := range vm.Ops {
-		if strings.Contains(s, op) {
-			// NOTE: I've changed to a VERB SUBJECT OBJECT from SUBJECT VERB OBJECT form
-			parts := strings.SplitN(strings.TrimSpace(s), " ", 3)
-			if len(parts) == 3 {
-				return SourceMap{Label: parts[1], Op: op, Source: parts[2], LineNo: lineNo, Expanded: ""}
-			}
-			if len(parts) == 2 {
-				return SourceMap{Label: parts[1], Op: op, Source: "", LineNo: lineNo, Expanded: ""}
-			}
-			return SourceMap{Label: "", Op: op, Source: "", LineNo: lineNo, Expanded: ""}
+	sm := SourceMap{Label: "", Op: "", Source: s, Filename: vm.filename, LineNo: lineNo, Column: 1, EndLineNo: lineNo, Expanded: ""}
+	lines := strings.Split(strings.TrimRight(s, "\r\n"), "\n")
+	tokens := vm.Tokenize(lines[0], lineNo)
+	heredoc := len(lines) > 1 && heredocStart(tokens) != ""
+	if heredoc == false {
+		tokens = vm.Tokenize(s, lineNo)
+	}
+	// NOTE: I've changed to a VERB SUBJECT OBJECT from SUBJECT VERB OBJECT form
+	for _, token := range tokens {
+		switch token.Type {
+		case OperatorToken:
+			sm.Op, sm.Source = token.Value, ""
+		case LabelToken:
+			sm.Label, sm.Column = token.Value, token.Column
+		case SourceToken:
+			sm.Source, sm.Column = token.Value, token.Column
+		case CommentToken:
+			sm.Op, sm.Source, sm.Column = CommentOp, token.Value, token.Column
+		case TextToken:
+			sm.Source, sm.Column = token.Value, token.Column
 		}
 	}
-	return SourceMap{Label: "", Op: "", Source: s, LineNo: lineNo, Expanded: ""}
+	if heredoc {
+		body, cnt, _ := parseHeredoc(lines[1:], heredocTag(sm.Source), vm.indented)
+		sm.Source = body
+		sm.EndLineNo = lineNo + cnt
+	}
+	return sm
 }
 
-// Expand takes some text and expands all labels to their values
+// isExit reports if the line is an :exit: or :quit: statement
+func (vm *VirtualMachine) isExit(s string) bool {
+	return vm.isOperator(s, ":exit:", ":quit:")
+}
+
+// Expand takes some text and expands all labels to their values.
+// The text is scanned once, left to right, at each position the longest
+// matching label is replaced and the substituted value is not scanned
+// again. This makes the expansion the same from run to run even when
+// labels overlap (e.g. @date and @dateString). In strict mode undefined
+// labels in the text and in the substituted values are reported.
 func (vm *VirtualMachine) Expand(text string) string {
+	vm.checkLabels(text, 0)
+	e := vm.getExpander()
+	if vm.strict == false {
+		return e.replace(text)
+	}
+	result, _ := e.expand(text, 0, func(i int, start int) (string, error) {
+		vm.checkLabels(e.values[i], vm.labelColumn(text, start))
+		return e.values[i], nil
+	})
+	return result
+}
+
+// getExpander returns the expander for the current symbol table
+func (vm *VirtualMachine) getExpander() *expander {
 	// labels hash should also point at the last known state of
-	// the label
-	result := text
-	symbols := vm.Symbols.GetSymbols()
-	for _, sm := range symbols {
-		if strings.Contains(text, sm.Label) {
-			tmp := strings.Replace(result, sm.Label, sm.Expanded, -1)
-			result = tmp
+	// the label, the expander is only rebuilt when they change.
+	if vm.expander == nil || vm.expanderTable != vm.Symbols || vm.expanderVersion != vm.Symbols.generation() {
+		vm.expander = newExpander(vm.Symbols.GetSymbols())
+		vm.expanderTable = vm.Symbols
+		vm.expanderVersion = vm.Symbols.generation()
+	}
+	return vm.expander
+}
+
+// checkLabels adds a warning for each label in text that is not defined when in
+// strict mode. The labels are reported at column, when it is zero each is
+// reported at its own position (e.g. labels in a substituted value are
+// reported where the label it was substituted for is).
+func (vm *VirtualMachine) checkLabels(text string, column int) {
+	if vm.strict {
+		labels, offsets := vm.labelSyntax.findLabels(text)
+		for i, label := range labels {
+			if vm.Symbols.defined(label) == false {
+				at := column
+				if at == 0 {
+					at = vm.labelColumn(text, offsets[i])
+				}
+				vm.warn(label, at)
+			}
 		}
 	}
-	return result
+}
+
+// labelColumn returns the column of offset in text. Text that isn't the
+// source of the statement being evaluated, e.g. the contents of a file,
+// is reported at the start of the source.
+func (vm *VirtualMachine) labelColumn(text string, offset int) int {
+	if vm.column == 0 {
+		return offset + 1
+	}
+	if text == vm.source {
+		return vm.column + offset
+	}
+	return vm.column
 }
 
 // Eval stores a shorthand assignment or expands and writes the content to stdout
-// Returns the expanded  and any error
+// Returns the expanded  and any error. Comments and the lines of a hidden
+// conditional section are dropped.
 func (vm *VirtualMachine) Eval(s string, lineNo int) (string, error) {
+	vm.lineNo = lineNo
 	sm := vm.Parse(s, lineNo)
+	vm.source, vm.column = sm.Source, sm.Column
+	if vm.skipping() && isSectionOp(sm.Op) == false {
+		return "", nil
+	}
+	if sm.Op == CommentOp {
+		return "", nil
+	}
 	// If not an assignment Expand and return the expansion
 	if sm.Label == "" && sm.Op == "" {
-		return fmt.Sprintf("%s", vm.Expand(s)), nil
+		if vm.recursive {
+			s, err := vm.ExpandRecursive(sm.Source)
+			return s, atSource(sm, err)
+		}
+		return fmt.Sprintf("%s", vm.Expand(sm.Source)), nil
 	}
 	return "", vm.EvalSymbol(sm)
 }
 
-// EvalSymbol accepts a symbol (i.e. SourceMap), applies a callback and updates the symbol table
+// EvalSymbol accepts a symbol (i.e. SourceMap), applies a callback and updates the symbol table.
+// An Op without a callback is an UnknownOperatorError.
 func (vm *VirtualMachine) EvalSymbol(sm SourceMap) error {
 	callback, ok := vm.Operators[sm.Op]
 	if ok == false {
-		return fmt.Errorf("ERROR (%d): `%s %s %s` is not a supported assignment.\n", sm.LineNo, sm.Op, sm.Label, sm.Source)
+		pos := sm
+		pos.Column = 1
+		return &UnknownOperatorError{SourceMap: pos}
 	}
 
 	// Make the associated assignment and save the symbol to the symbol table.
 	newSM, err := callback(vm, sm)
 	if err != nil {
-		return err
+		return atSource(sm, err)
+	}
+	// Conditional sections and scopes don't make an assignment
+	if isSectionOp(sm.Op) || isScopeOp(sm.Op) {
+		return nil
+	}
+	if newSM.EndLineNo == 0 {
+		newSM.EndLineNo = sm.EndLineNo
+	}
+	if newSM.Filename == "" && newSM.Column == 0 {
+		newSM.Filename, newSM.Column = sm.Filename, sm.Column
+	}
+
+	// Operators like :export: return the current assignment unchanged,
+	// it doesn't need to be added to the history again.
+	if vm.Symbols.defined(newSM.Label) && vm.Symbols.GetSymbol(newSM.Label) == newSM {
+		return nil
+	}
+	if err := vm.Symbols.checkAssign(newSM); err != nil {
+		return atSource(sm, err)
 	}
 
 	vm.Symbols.SetSymbol(newSM)
@@ -329,48 +970,153 @@ func (vm *VirtualMachine) EvalSymbol(sm SourceMap) error {
 }
 
 // Apply takes a byte array, and processes it returning a byte array. It is
-// like Run but for embedded uses of Shorthand.
+// like Run but for embedded uses of Shorthand. Processing stops when the
+// context set with SetContext is done. When errors are collected the
+// output is returned with the ErrorList.
 func (vm *VirtualMachine) Apply(src []byte) ([]byte, error) {
-	vm.SetPrompt("")
+	out := new(bytes.Buffer)
+	if err := vm.ApplyStream(vm.Context(), bytes.NewReader(src), out); err != nil {
+		if _, ok := err.(ErrorList); ok {
+			return out.Bytes(), err
+		}
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
 
-	out := []string{}
-	for lineNo, line := range strings.Split(string(src), "\n") {
-		if strings.Contains(line, ":exit:") || strings.Contains(line, ":quit:") {
+// ApplyStream reads shorthand from in a line at a time and writes the
+// results to out, only the statement being evaluated is held in memory.
+// The output is the same as Apply, the results of each statement are
+// separated by a line feed. Processing stops at the first error, which
+// includes the file and line number, or when ctx is done. When the
+// ErrorMode is CollectAll processing continues and every error is
+// returned in an ErrorList. ctx is passed to shell operators while
+// ApplyStream runs.
+func (vm *VirtualMachine) ApplyStream(ctx context.Context, in io.Reader, out io.Writer) error {
+	vm.SetPrompt("")
+	saved := vm.ctx
+	defer func() {
+		// Sections left open by an error end with the input
+		vm.ctx, vm.sections = saved, nil
+	}()
+	vm.ctx = ctx
+
+	reader := newSplitReader(vm, bufio.NewReader(in))
+	sep := ""
+	errs := ErrorList{}
+	for {
+		if err := ctx.Err(); err != nil {
+			if len(errs) > 0 {
+				errs.add(err)
+				return errs
+			}
+			return err
+		}
+		stmt, lineNo, err := reader.Next()
+		if err == io.EOF {
 			break
 		}
-		r, err := vm.Eval(line, lineNo)
 		if err != nil {
-			return nil, fmt.Errorf("line (%d): %s\n", lineNo, err)
+			err = &Error{SourceMap: SourceMap{Filename: vm.filename, LineNo: lineNo, Column: 1}, Err: err}
+			if vm.errorMode != CollectAll {
+				return err
+			}
+			// The rest of the input was read looking for the heredoc's end
+			errs.add(err)
+			break
+		}
+		if vm.isExit(stmt) && vm.skipping() == false {
+			break
+		}
+		// Comments are dropped without leaving an empty line
+		if vm.isOperator(stmt, CommentOp) {
+			continue
+		}
+		// So are conditional sections and the lines they hide
+		drop := vm.skipping() || vm.isOperator(stmt, IfOp, ElseOp, EndIfOp)
+		r, err := vm.Eval(stmt, lineNo)
+		if err != nil {
+			if vm.errorMode != CollectAll {
+				return err
+			}
+			errs.add(err)
 		}
-		out = append(out, r)
+		if drop {
+			continue
+		}
+		if s := sep + r; s != "" {
+			if _, err := io.WriteString(out, s); err != nil {
+				return err
+			}
+		}
+		sep = "\n"
+	}
+	if err := vm.closeSections(); err != nil {
+		if vm.errorMode != CollectAll {
+			return err
+		}
+		errs.add(err)
+	}
+	if len(errs) > 0 {
+		return errs
 	}
-	return []byte(strings.Join(out, "\n")), nil
+	return nil
 }
 
-// Run takes a reader (e.g. os.Stdin), and two writers (e.g. os.Stdout and os.Stderr)
-// It reads until EOF, :exit:, or :quit: operation is encountered
-// returns the number of lines processed.
+// Run takes a reader (e.g. os.Stdin), if in is nil vm.In is read. Prompts and output
+// are written to vm.Out, errors and warnings to vm.Eout.
+// It reads until EOF, :exit:, or :quit: operation is encountered or the
+// VM's context is done, returns the number of lines processed. Each error
+// is reported and processing continues unless the ErrorMode is FailFast.
+// With FailFast or CollectAll the errors are added to vm.Errors.
 func (vm *VirtualMachine) Run(in *bufio.Reader) int {
-	lineNo := 0
+	if in == nil {
+		in = bufio.NewReader(vm.In)
+	}
+	reader := newStatementReader(vm, in)
+	reported := len(vm.Warnings)
+	report := func(err error) {
+		fmt.Fprintf(vm.Eout, "%s\n", err)
+		if vm.errorMode != DefaultErrors {
+			vm.Errors.add(err)
+		}
+	}
 	for {
+		if err := vm.Context().Err(); err != nil {
+			report(&Error{SourceMap: SourceMap{Filename: vm.filename, LineNo: reader.lineNo, Column: 1}, Err: err})
+			break
+		}
 		if vm.prompt != "" {
-			fmt.Fprint(os.Stdout, vm.prompt)
+			fmt.Fprint(vm.Out, vm.prompt)
+		}
+		src, lineNo, rErr := reader.Next()
+		if rErr == io.EOF {
+			break
 		}
-		src, rErr := in.ReadString('\n')
 		if rErr != nil {
+			report(&Error{SourceMap: SourceMap{Filename: vm.filename, LineNo: lineNo, Column: 1}, Err: rErr})
 			break
 		}
-		lineNo++
-		if strings.Contains(src, ":exit:") || strings.Contains(src, ":quit:") {
+		if vm.isExit(src) && vm.skipping() == false {
 			break
 		}
 		out, err := vm.Eval(src, lineNo)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "ERROR (%d): %s\n", lineNo, err)
+			report(err)
+		}
+		for ; reported < len(vm.Warnings); reported++ {
+			fmt.Fprintf(vm.Eout, "%s\n", vm.Warnings[reported])
 		}
 		if out != "" {
-			fmt.Fprint(os.Stdout, out)
+			fmt.Fprint(vm.Out, out)
 		}
+		if err != nil && vm.errorMode == FailFast {
+			vm.sections = nil
+			break
+		}
+	}
+	if err := vm.closeSections(); err != nil {
+		report(err)
 	}
-	return lineNo
+	return reader.lineNo
 }
@@ -16,11 +16,17 @@ package shorthand
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"strings"
 	"testing"
+	"testing/fstest"
 	"time"
 )
 
@@ -415,7 +421,7 @@ func TestEval(t *testing.T) {
 		s, err := vm.Eval(src, i)
 		sm := vm.Symbols.GetSymbol(eSM.Label)
 		if notOk(err == nil) {
-			fmt.Sprintf("err should be nill: %s", err)
+			t.Errorf("err should be nill: %s", err)
 		}
 		if eSM.Label == "" && eSM.Op == "" {
 			if notOk(s != "") {
@@ -742,15 +748,10 @@ func TestExpandingSourcesToFile(t *testing.T) {
 		"testdata/expansion2.txt": "Hello World\nHello Max\n",
 	}
 
-	// Clean up testdata area
-	for fname := range testFiles {
-		if _, err := os.Stat(fname); err != nil {
-			os.Remove(fname)
-		}
-	}
-
 	//Generate test data and verify output
 	vm := New()
+	files := NewMemFS()
+	vm.WriteFS = files
 
 	testData := []string{
 		":set: @hello_world Hello World",
@@ -767,7 +768,7 @@ func TestExpandingSourcesToFile(t *testing.T) {
 	}
 
 	for fname, expectedText := range testFiles {
-		buf, err := ioutil.ReadFile(fname)
+		buf, err := files.ReadFile(fname)
 		if notOk(err == nil) {
 			t.Errorf("%s error: %s", fname, err)
 		}
@@ -786,13 +787,9 @@ func TestExportAssignments(t *testing.T) {
 		"testdata/assigned1.txt": ":set: @hello_world Hello World",
 		"testdata/assigned2.txt": ":set: @hello_world Hello World\n:bash: @max echo -n 'Hello Max'\n",
 	}
-	for fname := range testFiles {
-		if _, err := os.Stat(fname); err != nil {
-			os.Remove(fname)
-		}
-	}
-
 	vm := New()
+	files := NewMemFS()
+	vm.WriteFS = files
 
 	testData := []string{
 		`:set: @hello_world Hello World`,
@@ -809,7 +806,7 @@ func TestExportAssignments(t *testing.T) {
 	}
 
 	for fname, text := range testFiles {
-		buf, err := ioutil.ReadFile(fname)
+		buf, err := files.ReadFile(fname)
 		if notOk(err == nil) {
 			t.Errorf("Should beable to read %q", fname)
 		}
@@ -842,3 +839,1746 @@ func TestRun(t *testing.T) {
 	}
 	fmt.Println("Success.")
 }
+
+func TestTokenize(t *testing.T) {
+	vm := New()
+
+	tokens := vm.Tokenize(":set: {{name}}   Freda  Doe \n", 3)
+	if notOk(len(tokens) == 3) {
+		t.Fatalf("expected 3 tokens, got %+v", tokens)
+	}
+	expected := []Token{
+		{Type: OperatorToken, Value: ":set:", LineNo: 3, Column: 1},
+		{Type: LabelToken, Value: "{{name}}", LineNo: 3, Column: 7},
+		{Type: SourceToken, Value: "Freda  Doe", LineNo: 3, Column: 18},
+	}
+	for i, token := range tokens {
+		if notOk(token == expected[i]) {
+			t.Errorf("expected %+v, got %+v", expected[i], token)
+		}
+	}
+
+	// Operators are only recognized in leading position
+	testData := []string{
+		"Use :set: to assign a string to a label",
+		"  :set: {{name}} indented is text",
+		":set:{{name}} Freda",
+		"The :bash: operator runs a command",
+		":unknown: {{name}} Freda",
+	}
+	for _, src := range testData {
+		tokens = vm.Tokenize(src, 1)
+		if notOk(len(tokens) == 1 && tokens[0].Type == TextToken && tokens[0].Value == src) {
+			t.Errorf("expected a single text token for %q, got %+v", src, tokens)
+		}
+		sm := vm.Parse(src, 1)
+		if notOk(sm.Op == "" && sm.Label == "" && sm.Source == src) {
+			t.Errorf("expected %q to parse as text, got %+v", src, sm)
+		}
+	}
+
+	// In indented mode indented statements are assignments, indented
+	// text is kept as it is
+	vm.SetIndented(true)
+	tokens = vm.Tokenize("    :set: {{name}} Freda\n", 1)
+	if notOk(len(tokens) == 3 && tokens[0].Column == 5 && tokens[1].Value == "{{name}}" && tokens[2].Value == "Freda" && tokens[2].Column == 20) {
+		t.Errorf("expected an indented assignment, got %+v", tokens)
+	}
+	tokens = vm.Tokenize("\t\\:set: {{name}} Freda", 1)
+	if notOk(len(tokens) == 1 && tokens[0].Type == TextToken && tokens[0].Value == "\t:set: {{name}} Freda") {
+		t.Errorf("expected an escaped indented operator to be text, got %+v", tokens)
+	}
+	out, err := vm.Apply([]byte("Getting the year:\n\n    :set: @year 2019\n\n    :expand: {{footer}} <<END\n    &copy; @year\n    END\n    indented @year\n{{footer}}"))
+	if expected := "Getting the year:\n\n\n\n\n    indented 2019\n    &copy; 2019"; notOk(err == nil && string(out) == expected) {
+		t.Errorf("expected %q, got %q, %v", expected, out, err)
+	}
+	vm.SetIndented(false)
+
+	// Longest operator wins and a bare operator has no label or source
+	tokens = Tokenize(":export-all: _ out.txt", 1, []string{":export:", ":export-all:"})
+	if notOk(tokens[0].Value == ":export-all:") {
+		t.Errorf("expected :export-all:, got %+v", tokens[0])
+	}
+	tokens = vm.Tokenize(":set:", 1)
+	if notOk(len(tokens) == 1 && tokens[0].Type == OperatorToken) {
+		t.Errorf("expected a single operator token, got %+v", tokens)
+	}
+
+	// Prose mentioning an operator is expanded, not assigned
+	vm.Eval(":set: {{name}} Freda", 1)
+	s, err := vm.Eval("Write :set: {{name}} Freda to assign {{name}}", 2)
+	if notOk(err == nil) {
+		t.Errorf("expected no error, got %s", err)
+	}
+	if notOk(s == "Write :set: Freda Freda to assign Freda") {
+		t.Errorf("expected prose to be expanded, got %q", s)
+	}
+}
+
+func TestExpandLongestMatch(t *testing.T) {
+	assignments := []string{
+		":set: @date 2019-01-02",
+		":set: @dateString January 2, 2019",
+		":set: @d D",
+		":set: @at @date",
+	}
+	text := "@dateString, @date, @d, @dates @at"
+	expected := "January 2, 2019, 2019-01-02, D, 2019-01-02s @date"
+
+	// Define the labels in different orders and expand repeatedly,
+	// the result should never change.
+	for i := 0; i < 20; i++ {
+		vm := New()
+		for j := range assignments {
+			src := assignments[(i+j)%len(assignments)]
+			if _, err := vm.Eval(src, j+1); err != nil {
+				t.Fatalf("%q, %s", src, err)
+			}
+		}
+		for k := 0; k < 5; k++ {
+			result := vm.Expand(text)
+			if notOk(result == expected) {
+				t.Fatalf("pass %d.%d expected %q, got %q", i, k, expected, result)
+			}
+		}
+	}
+
+	// Substituted text is not scanned again
+	vm := New()
+	vm.Eval(":set: {{a}} {{b}}", 1)
+	vm.Eval(":set: {{b}} {{a}}", 2)
+	result := vm.Expand("{{a}}{{b}}")
+	if notOk(result == "{{b}}{{a}}") {
+		t.Errorf("expected %q, got %q", "{{b}}{{a}}", result)
+	}
+
+	// GetSymbols is ordered by assignment
+	vm.Eval(":set: {{a}} A", 3)
+	symbols := vm.Symbols.GetSymbols()
+	if notOk(len(symbols) == 2 && symbols[0].Label == "{{b}}" && symbols[1].Label == "{{a}}") {
+		t.Errorf("expected {{b}} then {{a}}, got %+v", symbols)
+	}
+}
+
+// expandReplace is the original approach to Expand, one strings.Replace
+// over the whole text per label. It is kept here for the benchmarks.
+func expandReplace(vm *VirtualMachine, text string) string {
+	result := text
+	for _, sm := range vm.Symbols.GetSymbols() {
+		if strings.Contains(text, sm.Label) {
+			result = strings.Replace(result, sm.Label, sm.Expanded, -1)
+		}
+	}
+	return result
+}
+
+// expandScan is a straight forward leftmost longest expansion used to
+// check the automaton.
+func expandScan(labels map[string]string, text string) string {
+	var result strings.Builder
+	for i := 0; i < len(text); {
+		label := ""
+		for l := range labels {
+			if len(l) > len(label) && strings.HasPrefix(text[i:], l) {
+				label = l
+			}
+		}
+		if label == "" {
+			result.WriteByte(text[i])
+			i++
+			continue
+		}
+		result.WriteString(labels[label])
+		i += len(label)
+	}
+	return result.String()
+}
+
+func TestExpander(t *testing.T) {
+	labels := map[string]string{
+		"abcde": "1",
+		"bcd":   "2",
+		"b":     "3",
+		"cd":    "4",
+		"ab":    "5",
+		"e":     "6",
+		"bcdef": "7",
+	}
+	symbols := []SourceMap{}
+	for label, value := range labels {
+		symbols = append(symbols, SourceMap{Label: label, Expanded: value})
+	}
+	e := newExpander(symbols)
+	testData := []string{
+		"", "abcde", "abcdef", "xbcdx", "abcd", "bcdefg", "aabcdee", "cdcdb", "zzz",
+	}
+	// Add some generated strings over the same alphabet
+	alphabet := "abcdefx"
+	for i := 0; i < 500; i++ {
+		s := ""
+		for j := i; j > 0; j /= len(alphabet) {
+			s += string(alphabet[j%len(alphabet)])
+		}
+		testData = append(testData, s+s)
+	}
+	for _, text := range testData {
+		expected := expandScan(labels, text)
+		result := e.replace(text)
+		if notOk(result == expected) {
+			t.Errorf("%q expected %q, got %q", text, expected, result)
+		}
+	}
+
+	// The automaton is only rebuilt when the symbol table changes
+	vm := New()
+	vm.Eval(":set: @one 1", 1)
+	vm.Expand("@one")
+	cached := vm.expander
+	vm.Expand("@one @one")
+	if notOk(cached == vm.expander) {
+		t.Errorf("expected the expander to be reused")
+	}
+	vm.Eval(":set: @two 2", 2)
+	if result := vm.Expand("@one @two"); notOk(result == "1 2") {
+		t.Errorf("expected %q, got %q", "1 2", result)
+	}
+	if notOk(cached != vm.expander) {
+		t.Errorf("expected the expander to be rebuilt")
+	}
+}
+
+// benchmarkVM returns a VM with n labels defined and a document that
+// uses each of them along with some text that does not change.
+func benchmarkVM(n int) (*VirtualMachine, string) {
+	vm := New()
+	var doc strings.Builder
+	for i := 0; i < n; i++ {
+		vm.Eval(fmt.Sprintf(":set: {{label%d}} value %d", i, i), i+1)
+		doc.WriteString(fmt.Sprintf("<p>Some text about {{label%d}} that is not a label.</p>\n", i))
+	}
+	text := strings.Repeat(doc.String(), 10)
+	return vm, text
+}
+
+func BenchmarkExpand(b *testing.B) {
+	vm, text := benchmarkVM(500)
+	b.SetBytes(int64(len(text)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		vm.Expand(text)
+	}
+}
+
+func BenchmarkExpandReplace(b *testing.B) {
+	vm, text := benchmarkVM(500)
+	b.SetBytes(int64(len(text)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		expandReplace(vm, text)
+	}
+}
+
+func TestHeredoc(t *testing.T) {
+	vm := New()
+	src := ":set: {{footer}} <<END\n<footer>\n  :set: {{x}} not an assignment\n</footer>\nEND\n"
+	sm := vm.Parse(src, 4)
+	expected := "<footer>\n  :set: {{x}} not an assignment\n</footer>"
+	if notOk(sm.Op == ":set:" && sm.Label == "{{footer}}" && sm.Source == expected) {
+		t.Errorf("expected heredoc source %q, got %+v", expected, sm)
+	}
+	if notOk(sm.LineNo == 4 && sm.EndLineNo == 8) {
+		t.Errorf("expected lines 4 to 8, got %d to %d", sm.LineNo, sm.EndLineNo)
+	}
+
+	// A single line assignment starts and ends on the same line
+	sm = vm.Parse(":set: {{footer}} <<END", 2)
+	if notOk(sm.Source == "<<END" && sm.EndLineNo == 2) {
+		t.Errorf("expected a single line assignment, got %+v", sm)
+	}
+
+	// Apply
+	text := `:set: {{name}} Freda
+:expand: {{greeting}} <<EOT
+Hello {{name}},
+EOT
+:set: {{closing}} Bye
+{{greeting}}
+{{closing}}`
+	out, err := vm.Apply([]byte(text))
+	if notOk(err == nil) {
+		t.Errorf("Apply error: %s", err)
+	}
+	if notOk(string(out) == "\n\n\nHello Freda,\nBye") {
+		t.Errorf("unexpected Apply output %q", out)
+	}
+	sm = vm.Symbols.GetSymbol("{{greeting}}")
+	if notOk(sm.LineNo == 2 && sm.EndLineNo == 4) {
+		t.Errorf("expected {{greeting}} at lines 2 to 4, got %+v", sm)
+	}
+	_, err = vm.Apply([]byte(":set: {{open}} <<END\nnever closed\n"))
+	if notOk(err != nil) {
+		t.Errorf("expected an error for an unterminated heredoc")
+	}
+
+	// Run
+	vm = New()
+	cnt := vm.Run(bufio.NewReader(strings.NewReader(":set: {{a}} <<END\none\ntwo\nEND\n:set: {{b}} B\n")))
+	if notOk(cnt == 5) {
+		t.Errorf("expected 5 lines, got %d", cnt)
+	}
+	if result := vm.Expand("{{a}}{{b}}"); notOk(result == "one\ntwoB") {
+		t.Errorf("unexpected expansion %q", result)
+	}
+
+	// ImportAssignments
+	vm = New()
+	if _, err := vm.Eval(":import-shorthand: _ testdata/heredoc.shorthand", 1); err != nil {
+		t.Fatalf("import error: %s", err)
+	}
+	if result := vm.Expand("{{footer}}|{{after}}"); notOk(result == "<footer>\n  Heredoc Test\n</footer>|after the heredoc") {
+		t.Errorf("unexpected expansion %q", result)
+	}
+	sm = vm.Symbols.GetSymbol("{{after}}")
+	if notOk(sm.LineNo == 7) {
+		t.Errorf("expected {{after}} on line 7, got %d", sm.LineNo)
+	}
+
+	// Multi-line sources are exported as heredocs and can be read back
+	sm = SourceMap{Op: ":set:", Label: "{{x}}", Source: "one\nEND\ntwo"}
+	s := formatAssignment(sm)
+	if notOk(s == ":set: {{x}} <<END1\none\nEND\ntwo\nEND1") {
+		t.Errorf("unexpected heredoc %q", s)
+	}
+	if result := vm.Parse(s, 1); notOk(result.Source == sm.Source) {
+		t.Errorf("expected %q, got %q", sm.Source, result.Source)
+	}
+}
+
+func TestComments(t *testing.T) {
+	vm := New()
+	tokens := vm.Tokenize(":comment: this is not :set: output\n", 1)
+	if notOk(len(tokens) == 1 && tokens[0].Type == CommentToken && tokens[0].Value == "this is not :set: output") {
+		t.Errorf("expected a comment token, got %+v", tokens)
+	}
+	sm := vm.Parse(":comment: {{name}} is a label", 1)
+	if notOk(sm.Op == CommentOp && sm.Label == "") {
+		t.Errorf("expected a comment, got %+v", sm)
+	}
+	s, err := vm.Eval(":comment: {{name}} is a label", 1)
+	if notOk(err == nil && s == "") {
+		t.Errorf("expected comment to be dropped, got %q, %s", s, err)
+	}
+	if notOk(len(vm.Symbols.GetSymbols()) == 0) {
+		t.Errorf("a comment should not assign a label")
+	}
+
+	text := `:comment: build the greeting
+:set: {{name}} Freda
+:comment: <<END
+:set: {{name}} not Freda
+this text is a comment too
+END
+Hello {{name}}
+  :comment: is text when not in the first column
+Not a :comment: when it follows text`
+	out, err := vm.Apply([]byte(text))
+	if notOk(err == nil) {
+		t.Errorf("Apply error: %s", err)
+	}
+	expected := "\nHello Freda\n  :comment: is text when not in the first column\nNot a :comment: when it follows text"
+	if notOk(string(out) == expected) {
+		t.Errorf("expected %q, got %q", expected, out)
+	}
+
+	vm = New()
+	fp, err := os.Open("testdata/comments.shorthand")
+	if err != nil {
+		t.Fatalf("Should be able to open testdata/comments.shorthand")
+	}
+	defer fp.Close()
+	vm.Run(bufio.NewReader(fp))
+	if notOk(vm.Expand("{{name}}") == "Freda") {
+		t.Errorf("expected {{name}} to be Freda, got %q", vm.Expand("{{name}}"))
+	}
+}
+
+func TestEscapes(t *testing.T) {
+	vm := New()
+	vm.Eval(":set: {{pageTitle}} My Page", 1)
+
+	testData := map[string]string{
+		`\{{pageTitle}}`:                         `{{pageTitle}}`,
+		`Title: \{{pageTitle}} is {{pageTitle}}`: `Title: {{pageTitle}} is My Page`,
+		`\\{{pageTitle}}`:                        `\My Page`,
+		`\\\{{pageTitle}}`:                       `\{{pageTitle}}`,
+		`a \ backslash`:                          `a \ backslash`,
+		`\:set: {{pageTitle}} Hello`:             `:set: My Page Hello`,
+		`\:set: \{{pageTitle}} Hello`:            `:set: {{pageTitle}} Hello`,
+		`\\:set: \{{pageTitle}} Hello`:           `\:set: {{pageTitle}} Hello`,
+		`\:comment: shown`:                       `:comment: shown`,
+		`\:unknown: is not an operator`:          `\:unknown: is not an operator`,
+	}
+	for src, expected := range testData {
+		s, err := vm.Eval(src, 2)
+		if notOk(err == nil) {
+			t.Errorf("%q error: %s", src, err)
+		}
+		if notOk(s == expected) {
+			t.Errorf("%q expected %q, got %q", src, expected, s)
+		}
+	}
+	if notOk(vm.Expand("{{pageTitle}}") == "My Page") {
+		t.Errorf("an escaped assignment should not change {{pageTitle}}")
+	}
+
+	// An escaped label in an assignment stays literal
+	vm.Eval(`:expand: {{example}} Use \{{pageTitle}} for {{pageTitle}}`, 3)
+	if s := vm.Expand("{{example}}"); notOk(s == "Use {{pageTitle}} for My Page") {
+		t.Errorf("unexpected expansion %q", s)
+	}
+
+	// An escaped :exit: does not stop Apply
+	vm.RegisterOp(":exit:", AssignString, "Exit")
+	out, err := vm.Apply([]byte("\\:exit:\n{{pageTitle}}"))
+	if notOk(err == nil && string(out) == ":exit:\nMy Page") {
+		t.Errorf("unexpected Apply output %q, %s", out, err)
+	}
+}
+
+func TestStrict(t *testing.T) {
+	ls, err := ParseLabelSyntax("{{...}}")
+	if notOk(err == nil && ls == CurlyBraces) {
+		t.Errorf("expected %+v, got %+v, %s", CurlyBraces, ls, err)
+	}
+	if _, err := ParseLabelSyntax("{{}}"); notOk(err != nil) {
+		t.Errorf("expected an error for a syntax without ...")
+	}
+	labels := CurlyBraces.FindLabels(`{{a}} {{b c}} \{{d}} \\{{e}} {{f}`)
+	if notOk(strings.Join(labels, ",") == "{{a}},{{e}}") {
+		t.Errorf("unexpected labels %q", labels)
+	}
+	labels = AtSign.FindLabels("@title, @date_1 and @ alone, email@example")
+	if notOk(strings.Join(labels, ",") == "@title,@date_1,@example") {
+		t.Errorf("unexpected labels %q", labels)
+	}
+
+	// Not strict, nothing is reported
+	vm := New()
+	vm.Eval("{{pageTitel}}", 1)
+	if notOk(len(vm.Warnings) == 0) {
+		t.Errorf("expected no warnings, got %+v", vm.Warnings)
+	}
+
+	vm = New()
+	vm.SetStrict(true)
+	vm.SetFilename("page.shorthand")
+	text := `:set: {{pageTitle}} My Page
+<h1>{{pageTitel}}</h1>
+<h2>{{pageTitle}} \{{literal}}</h2>
+:import-shorthand: _ testdata/strict.shorthand
+{{pageTitel}} {{pageTitel}}`
+	if _, err := vm.Apply([]byte(text)); err != nil {
+		t.Fatalf("Apply error: %s", err)
+	}
+	expected := []Warning{
+		{Filename: "page.shorthand", LineNo: 2, Column: 5, Label: "{{pageTitel}}"},
+		{Filename: "testdata/strict.shorthand", LineNo: 2, Column: 39, Label: "{{author}}"},
+		{Filename: "page.shorthand", LineNo: 5, Column: 1, Label: "{{pageTitel}}"},
+	}
+	if notOk(len(vm.Warnings) == len(expected)) {
+		t.Fatalf("expected %d warnings, got %+v", len(expected), vm.Warnings)
+	}
+	for i, w := range vm.Warnings {
+		if notOk(w == expected[i]) {
+			t.Errorf("expected %+v, got %+v", expected[i], w)
+		}
+	}
+	if s := vm.Warnings[0].String(); notOk(s == "page.shorthand:2:5: warning: {{pageTitel}} is not defined") {
+		t.Errorf("unexpected warning %q", s)
+	}
+
+	vm = New()
+	vm.SetStrict(true)
+	vm.SetLabelSyntax(AtSign)
+	vm.Eval(":set: @title Title", 1)
+	vm.Eval("@title by @author", 2)
+	if notOk(len(vm.Warnings) == 1 && vm.Warnings[0].Label == "@author") {
+		t.Errorf("expected a warning for @author, got %+v", vm.Warnings)
+	}
+
+	// Labels left in a substituted value are reported too
+	vm = New()
+	vm.SetStrict(true)
+	vm.Eval(":set: {{a}} see {{b}} and \\{{c}}", 1)
+	if s, _ := vm.Eval("{{a}}", 2); notOk(s == "see {{b}} and \\{{c}}") {
+		t.Errorf("expected the value unexpanded, got %q", s)
+	}
+	if notOk(len(vm.Warnings) == 1 && vm.Warnings[0].Label == "{{b}}" && vm.Warnings[0].LineNo == 2) {
+		t.Errorf("expected a warning for {{b}}, got %+v", vm.Warnings)
+	}
+	// at the column of the label it was substituted for
+	vm.SetRecursive(true)
+	vm.Eval("Read {{a}}", 3)
+	for _, w := range vm.Warnings[1:] {
+		if notOk(w.String() == "<input>:3:6: warning: {{b}} is not defined") {
+			t.Errorf("unexpected warning %q", w)
+		}
+	}
+	if notOk(len(vm.Warnings) == 2) {
+		t.Errorf("expected a warning on line 3, got %+v", vm.Warnings)
+	}
+}
+
+func TestExpandRecursive(t *testing.T) {
+	vm := New()
+	vm.Eval(":set: {{page}} {{header}}<main>{{body}}</main>", 1)
+	vm.Eval(":set: {{header}} <h1>{{title}}</h1>", 2)
+	vm.Eval(":set: {{title}} {{site}}: {{pageTitle}}", 3)
+	vm.Eval(":set: {{site}} My Site", 4)
+	vm.Eval(":set: {{pageTitle}} Home", 5)
+	vm.Eval(":set: {{body}} Welcome to {{site}}, \\{{site}}", 6)
+
+	expected := "<h1>My Site: Home</h1><main>Welcome to My Site, {{site}}</main>"
+	result, err := vm.ExpandRecursive("{{page}}")
+	if notOk(err == nil && result == expected) {
+		t.Errorf("expected %q, got %q, %s", expected, result, err)
+	}
+
+	// :expand-expansion: only makes two passes
+	vm.Eval(":expand-expansion: {{twice}} {{page}}", 7)
+	if s := vm.Expand("{{twice}}"); notOk(s != expected) {
+		t.Errorf("expected :expand-expansion: to stop early, got %q", s)
+	}
+	vm.Eval(":expand-recursive: {{all}} {{page}}", 8)
+	if s := vm.Expand("{{all}}"); notOk(s == expected) {
+		t.Errorf("expected %q, got %q", expected, s)
+	}
+
+	// Recursive mode applies to text
+	if s, _ := vm.Eval("{{header}}", 9); notOk(s == "<h1>{{title}}</h1>") {
+		t.Errorf("unexpected expansion %q", s)
+	}
+	vm.SetRecursive(true)
+	if s, _ := vm.Eval("{{header}}", 10); notOk(s == "<h1>My Site: Home</h1>") {
+		t.Errorf("unexpected expansion %q", s)
+	}
+
+	// Cycles report the chain of labels
+	vm.Eval(":set: {{a}} A {{b}}", 11)
+	vm.Eval(":set: {{b}} B {{c}}", 12)
+	vm.Eval(":set: {{c}} C {{a}}", 13)
+	_, err = vm.Eval("start {{b}}", 14)
+	if notOk(err != nil && strings.Contains(err.Error(), "{{b}} -> {{c}} -> {{a}} -> {{b}}")) {
+		t.Errorf("expected a cycle error, got %v", err)
+	}
+	vm.Eval(":set: {{self}} {{self}}", 15)
+	if _, err := vm.ExpandRecursive("{{self}}"); notOk(err != nil && strings.Contains(err.Error(), "{{self}} -> {{self}}")) {
+		t.Errorf("expected a cycle error, got %v", err)
+	}
+
+	// Depth is limited
+	vm = New()
+	for i := 0; i < 10; i++ {
+		vm.Eval(fmt.Sprintf(":set: {{l%d}} {{l%d}}", i, i+1), i+1)
+	}
+	vm.MaxDepth = 5
+	if _, err := vm.ExpandRecursive("{{l0}}"); notOk(err != nil && strings.Contains(err.Error(), "maximum depth")) {
+		t.Errorf("expected a depth error, got %v", err)
+	}
+	vm.MaxDepth = DefaultMaxDepth
+	if s, err := vm.ExpandRecursive("{{l0}}"); notOk(err == nil && s == "{{l10}}") {
+		t.Errorf("expected {{l10}}, got %q, %v", s, err)
+	}
+
+	// Zero is no limit, cycles are still found
+	vm = New()
+	vm.MaxDepth, vm.MaxExpansionSize = 0, 0
+	for i := 0; i < 10; i++ {
+		vm.Eval(fmt.Sprintf(":set: {{l%d}} {{l%d}}", i, i+1), i+1)
+	}
+	if s, err := vm.ExpandRecursive("{{l0}}"); notOk(err == nil && s == "{{l10}}") {
+		t.Errorf("expected {{l10}} with no limits, got %q, %v", s, err)
+	}
+	vm.Eval(":set: {{l10}} {{l0}}", 11)
+	if _, err := vm.ExpandRecursive("{{l0}}"); notOk(err != nil && strings.Contains(err.Error(), "expansion cycle")) {
+		t.Errorf("expected a cycle error with no limits, got %v", err)
+	}
+
+	// Billion laughs
+	vm = New()
+	vm.Eval(":set: {{lol0}} lol", 1)
+	for i := 1; i < 10; i++ {
+		l := fmt.Sprintf("{{lol%d}}", i-1)
+		vm.Eval(fmt.Sprintf(":set: {{lol%d}} %s", i, strings.Repeat(l, 10)), i+1)
+	}
+	vm.MaxExpansionSize = 1 << 20
+	if _, err := vm.ExpandRecursive("{{lol9}}"); notOk(err != nil && strings.Contains(err.Error(), "maximum size")) {
+		t.Errorf("expected a size error, got %v", err)
+	}
+	if s, err := vm.ExpandRecursive("{{lol3}}"); notOk(err == nil && len(s) == 3000) {
+		t.Errorf("expected 3000 bytes, got %d, %v", len(s), err)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	vm := New()
+	files := NewMemFS()
+	vm.ReadFS, vm.WriteFS = files, files
+	testData := []string{
+		":set: {{title}} First Title",
+		":set: {{author}} Freda",
+		":set: {{title}} Second Title",
+		":expand: {{title}} {{title}} and {{author}}",
+		":export: {{title}} testdata/history-title.txt",
+	}
+	for i, src := range testData {
+		if _, err := vm.Eval(src, i+1); err != nil {
+			t.Fatalf("%q error: %s", src, err)
+		}
+	}
+
+	history := vm.Symbols.GetHistory("{{title}}")
+	if notOk(len(history) == 3) {
+		t.Fatalf("expected 3 versions of {{title}}, got %+v", history)
+	}
+	expected := []string{"First Title", "Second Title", "Second Title and Freda"}
+	for i, sm := range history {
+		if notOk(sm.Expanded == expected[i]) {
+			t.Errorf("version %d expected %q, got %q", i+1, expected[i], sm.Expanded)
+		}
+	}
+	versions := map[int]string{1: "First Title", 2: "Second Title", 3: "Second Title and Freda", 0: "Second Title and Freda", -1: "Second Title", -2: "First Title"}
+	for version, value := range versions {
+		if sm := vm.Symbols.GetSymbolVersion("{{title}}", version); notOk(sm.Expanded == value) {
+			t.Errorf("version %d expected %q, got %q", version, value, sm.Expanded)
+		}
+	}
+	for _, version := range []int{4, -3} {
+		if sm := vm.Symbols.GetSymbolVersion("{{title}}", version); notOk(sm.LineNo == -1) {
+			t.Errorf("version %d should not exist, got %+v", version, sm)
+		}
+	}
+
+	// Entries are in parse order
+	entries := vm.Symbols.GetEntries()
+	if notOk(len(entries) == 4) {
+		t.Fatalf("expected 4 entries, got %+v", entries)
+	}
+	for i, sm := range entries {
+		if notOk(sm.LineNo == i+1) {
+			t.Errorf("expected entry %d from line %d, got %d", i, i+1, sm.LineNo)
+		}
+	}
+
+	// Operators
+	vm.Eval(":history: {{titles}} {{title}}", 6)
+	if s := vm.Expand("{{titles}}"); notOk(s == "1 (line 1): First Title\n2 (line 3): Second Title\n3 (line 4): Second Title and Freda") {
+		t.Errorf("unexpected history %q", s)
+	}
+	vm.Eval(":expand-version: {{firstTitle}} {{title}} 1", 7)
+	if s := vm.Expand("{{firstTitle}}"); notOk(s == "First Title") {
+		t.Errorf("unexpected version %q", s)
+	}
+	if _, err := vm.Eval(":expand-version: {{x}} {{title}} 10", 8); notOk(err != nil) {
+		t.Errorf("expected an error for a missing version")
+	}
+	if _, err := vm.Eval(":expand-version: {{x}} {{title}}", 9); notOk(err != nil) {
+		t.Errorf("expected an error for a missing version number")
+	}
+
+	fname := "testdata/history.shorthand"
+	if _, err := vm.Eval(":export-history: _ "+fname, 10); err != nil {
+		t.Fatalf("export error: %s", err)
+	}
+	buf, err := files.ReadFile(fname)
+	if err != nil {
+		t.Fatalf("Should be able to read %s", fname)
+	}
+	if notOk(strings.HasPrefix(string(buf), ":set: {{title}} First Title\n:set: {{author}} Freda\n:set: {{title}} Second Title\n")) {
+		t.Errorf("unexpected history file %q", buf)
+	}
+
+	// Replaying the history gives the same values
+	replay := New()
+	replay.ReadFS = files
+	if _, err := replay.Eval(":import-shorthand: _ "+fname, 1); err != nil {
+		t.Fatalf("replay error: %s", err)
+	}
+	for _, label := range []string{"{{title}}", "{{author}}", "{{firstTitle}}"} {
+		if notOk(replay.Expand(label) == vm.Expand(label)) {
+			t.Errorf("%s expected %q, got %q", label, vm.Expand(label), replay.Expand(label))
+		}
+	}
+}
+
+func TestScopes(t *testing.T) {
+	vm := New()
+	vm.Eval(":set: {{site}} My Site", 1)
+	vm.Eval(":set: {{title}} Caller Title", 2)
+
+	// Scopes read enclosing labels but assignments stay in the scope
+	vm.PushScope()
+	vm.Eval(":set: {{title}} Inner Title", 3)
+	vm.Eval(":set: {{inner}} Inner", 4)
+	if s := vm.Expand("{{site}}: {{title}} {{inner}}"); notOk(s == "My Site: Inner Title Inner") {
+		t.Errorf("unexpected expansion %q", s)
+	}
+	if err := vm.PopScope("{{inner}}"); err != nil {
+		t.Errorf("PopScope error: %s", err)
+	}
+	if s := vm.Expand("{{site}}: {{title}} {{inner}}"); notOk(s == "My Site: Caller Title Inner") {
+		t.Errorf("unexpected expansion %q", s)
+	}
+	if err := vm.PopScope(); notOk(err != nil) {
+		t.Errorf("expected an error popping the outer most scope")
+	}
+	vm.PushScope()
+	if err := vm.PopScope("{{missing}}"); notOk(err != nil) {
+		t.Errorf("expected an error exporting an undefined label")
+	}
+	vm.PopScope()
+
+	// Operators
+	vm.Eval(":push-scope: _", 5)
+	vm.Eval(":set: {{title}} Pushed", 6)
+	vm.Eval(":set: {{kept}} Kept", 7)
+	vm.Eval(":pop-scope: _ {{kept}}", 8)
+	if s := vm.Expand("{{title}} {{kept}}"); notOk(s == "Caller Title Kept") {
+		t.Errorf("unexpected expansion %q", s)
+	}
+	if s := vm.Expand("snake_case"); notOk(s == "snake_case" && vm.Symbols.defined("_") == false) {
+		t.Errorf("expected the scope operators not to assign _, got %q", s)
+	}
+	vm.Eval(":push-scope:", 8)
+	vm.Eval(":set: {{kept}} Kept again", 8)
+	vm.Eval(":set: {{also}} Also", 8)
+	vm.Eval(":pop-scope: {{kept}} {{also}}", 8)
+	if s := vm.Expand("{{title}} {{kept}} {{also}}"); notOk(s == "Caller Title Kept again Also") {
+		t.Errorf("unexpected expansion %q", s)
+	}
+
+	// :import-shorthand: shares the caller's labels, :import-scoped: does not
+	_, err := vm.Eval(":import-scoped: _ testdata/scoped.shorthand {{nav}}", 9)
+	if err != nil {
+		t.Fatalf("import error: %s", err)
+	}
+	if s := vm.Expand("{{title}}|{{nav}}|{{tmp}}"); notOk(s == "Caller Title|<nav>My Site helper value</nav>|{{tmp}}") {
+		t.Errorf("unexpected expansion %q", s)
+	}
+	if notOk(vm.Symbols.Parent() == nil) {
+		t.Errorf("expected to be back in the outer most scope")
+	}
+	if _, err := vm.Eval(":import-scoped: _ testdata/scoped.shorthand {{missing}}", 10); notOk(err != nil) {
+		t.Errorf("expected an error exporting an undefined label")
+	}
+	if notOk(vm.Symbols.Parent() == nil) {
+		t.Errorf("expected to be back in the outer most scope after an error")
+	}
+	vm.Eval(":import-shorthand: _ testdata/scoped.shorthand", 11)
+	if s := vm.Expand("{{title}}|{{tmp}}"); notOk(s == "Helper Title|helper value") {
+		t.Errorf("unexpected expansion %q", s)
+	}
+}
+
+func TestUnsetAndConst(t *testing.T) {
+	st := new(SymbolTable)
+	st.SetSymbol(SourceMap{Label: "@a", Op: ":set:", Source: "A", Expanded: "A", LineNo: 1})
+	if notOk(st.UnsetSymbol("@a")) {
+		t.Errorf("expected @a to be unset")
+	}
+	if notOk(st.GetSymbol("@a").LineNo == -1 && st.defined("@a") == false) {
+		t.Errorf("expected @a to be undefined, got %+v", st.GetSymbol("@a"))
+	}
+	if notOk(st.UnsetSymbol("@a") == false) {
+		t.Errorf("expected unsetting an undefined label to return false")
+	}
+	if notOk(len(st.GetHistory("@a")) == 2 && len(st.GetSymbols()) == 0) {
+		t.Errorf("unexpected history %+v or symbols %+v", st.GetHistory("@a"), st.GetSymbols())
+	}
+
+	vm := New()
+	vm.WriteFS = NewMemFS()
+	vm.Eval(":set: {{name}} Freda", 1)
+	if _, err := vm.Eval(":unset: {{name}}", 2); err != nil {
+		t.Errorf("unset error: %s", err)
+	}
+	if s := vm.Expand("Hello {{name}}"); notOk(s == "Hello {{name}}") {
+		t.Errorf("expected {{name}} to no longer expand, got %q", s)
+	}
+	if _, err := vm.Eval(":unset: {{name}}", 3); notOk(err != nil) {
+		t.Errorf("expected an error unsetting an undefined label")
+	}
+	vm.Eval(":set: {{name}} Max", 4)
+	if s := vm.Expand("Hello {{name}}"); notOk(s == "Hello Max") {
+		t.Errorf("unexpected expansion %q", s)
+	}
+
+	// Unsetting in a scope hides the enclosing label until the scope ends
+	vm.PushScope()
+	vm.Eval(":unset: {{name}}", 5)
+	if s := vm.Expand("{{name}}"); notOk(s == "{{name}}") {
+		t.Errorf("expected {{name}} to be hidden, got %q", s)
+	}
+	vm.PopScope()
+	if s := vm.Expand("{{name}}"); notOk(s == "Max") {
+		t.Errorf("expected {{name}} to be restored, got %q", s)
+	}
+
+	// Constants
+	vm.Eval(":const: {{site}} My Site", 6)
+	for i, src := range []string{
+		":set: {{site}} Other Site",
+		":const: {{site}} Other Site",
+		":expand: {{site}} {{name}}",
+		":unset: {{site}}",
+	} {
+		_, err := vm.Eval(src, 7+i)
+		if notOk(err != nil && strings.Contains(err.Error(), "{{site}} is a constant defined at line 6")) {
+			t.Errorf("%q expected a constant error, got %v", src, err)
+		}
+	}
+	if s := vm.Expand("{{site}}"); notOk(s == "My Site") {
+		t.Errorf("expected {{site}} to be unchanged, got %q", s)
+	}
+	if notOk(vm.Symbols.IsConstant("{{site}}") && vm.Symbols.IsConstant("{{name}}") == false) {
+		t.Errorf("expected only {{site}} to be a constant")
+	}
+	fname := "testdata/const.txt"
+	if _, err := vm.Eval(":export: {{site}} "+fname, 11); err != nil {
+		t.Errorf("exporting a constant should not be an error: %s", err)
+	}
+	vm.PushScope()
+	vm.Eval(":set: {{inner}} inner", 12)
+	if _, err := vm.Eval(":set: {{site}} Inner Site", 13); notOk(err != nil) {
+		t.Errorf("expected a constant error inside a scope")
+	}
+	vm.PopScope()
+}
+
+func TestRunIO(t *testing.T) {
+	vm := New()
+	if notOk(vm.In == os.Stdin && vm.Out == os.Stdout && vm.Eout == os.Stderr) {
+		t.Errorf("expected New() to use standard input, output and error")
+	}
+	out, eout := new(bytes.Buffer), new(bytes.Buffer)
+	vm.In = strings.NewReader(":set: {{name}} Freda\nHello {{name}}\n:expand-version: {{x}} {{name}} 5\nBye {{name}}")
+	vm.Out, vm.Eout = out, eout
+	vm.SetPrompt("? ")
+	vm.SetStrict(true)
+	cnt := vm.Run(nil)
+	if notOk(cnt == 4) {
+		t.Errorf("expected 4 lines, got %d", cnt)
+	}
+	if notOk(out.String() == "? ? Hello Freda\n? ? Bye Freda? ") {
+		t.Errorf("unexpected output %q", out.String())
+	}
+	if notOk(strings.HasPrefix(eout.String(), "<input>:3:24: ") && strings.Count(eout.String(), "\n") == 1) {
+		t.Errorf("unexpected errors %q", eout.String())
+	}
+
+	// Warnings go to Eout
+	out.Reset()
+	eout.Reset()
+	vm.SetPrompt("")
+	vm.Run(bufio.NewReader(strings.NewReader("{{missing}}\n")))
+	if notOk(out.String() == "{{missing}}\n" && eout.String() == "<input>:1:1: warning: {{missing}} is not defined\n") {
+		t.Errorf("unexpected output %q, errors %q", out.String(), eout.String())
+	}
+}
+
+func TestApplyStream(t *testing.T) {
+	testData := []string{
+		"",
+		"\n",
+		"Hello World",
+		":set: {{name}} Freda\nHello {{name}}\n",
+		":set: {{name}} Freda\n:comment: dropped\n:expand: {{greeting}} <<END\nHello {{name}}\nEND\n{{greeting}}\n:exit:\nnot reached",
+		"\r\n:set: {{x}} X\r\n{{x}}\r\n",
+	}
+	for _, src := range testData {
+		expected, err := New().Apply([]byte(src))
+		if err != nil {
+			t.Fatalf("%q Apply error: %s", src, err)
+		}
+		out := new(bytes.Buffer)
+		if err := New().ApplyStream(context.Background(), strings.NewReader(src), out); err != nil {
+			t.Errorf("%q ApplyStream error: %s", src, err)
+		}
+		if notOk(out.String() == string(expected)) {
+			t.Errorf("%q expected %q, got %q", src, expected, out.String())
+		}
+	}
+
+	// Errors include the file and line
+	vm := New()
+	vm.SetFilename("page.shorthand")
+	err := vm.ApplyStream(context.Background(), strings.NewReader("line one\n:import-text: {{x}} testdata/missing.txt\n"), ioutil.Discard)
+	if notOk(err != nil && strings.HasPrefix(err.Error(), "page.shorthand:2:21: ")) {
+		t.Errorf("expected an error at page.shorthand:2, got %v", err)
+	}
+
+	// Output is written as each statement is evaluated
+	vm = New()
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	done := make(chan error)
+	go func() {
+		err := vm.ApplyStream(context.Background(), inR, outW)
+		outW.Close()
+		done <- err
+	}()
+	fmt.Fprintln(inW, ":set: {{name}} Freda")
+	fmt.Fprintln(inW, "Hello {{name}}")
+	buf := make([]byte, 32)
+	n, _ := io.ReadAtLeast(outR, buf, len("\nHello Freda"))
+	if notOk(string(buf[:n]) == "\nHello Freda") {
+		t.Errorf("expected output before the input ends, got %q", buf[:n])
+	}
+	inW.Close()
+	ioutil.ReadAll(outR)
+	if err := <-done; err != nil {
+		t.Errorf("ApplyStream error: %s", err)
+	}
+
+	// Cancelled contexts stop processing
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := New().ApplyStream(ctx, strings.NewReader("Hello"), ioutil.Discard); notOk(err == context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestShellTimeout(t *testing.T) {
+	vm := New()
+	vm.CommandTimeout = 100 * time.Millisecond
+	start := time.Now()
+	_, err := vm.Eval(":bash: {{slow}} sleep 5", 3)
+	if notOk(err != nil) {
+		t.Fatalf("expected a timeout error")
+	}
+	if notOk(time.Since(start) < 4*time.Second) {
+		t.Errorf("command was not stopped, took %s", time.Since(start))
+	}
+	if notOk(strings.Contains(err.Error(), "sleep 5") && strings.Contains(err.Error(), "3") && strings.Contains(err.Error(), "timed out")) {
+		t.Errorf("expected the command and line in the error, got %q", err)
+	}
+
+	// Fast commands are not affected
+	out, err := vm.Eval(":bash: {{fast}} echo -n hello", 4)
+	if err != nil {
+		t.Errorf("unexpected error %s", err)
+	}
+	if out != "" || vm.Symbols.GetSymbol("{{fast}}").Expanded != "hello" {
+		t.Errorf("expected {{fast}} to be hello, got %q", vm.Symbols.GetSymbol("{{fast}}").Expanded)
+	}
+
+	// A deadline for the whole run stops the command and processing
+	vm = New()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	err = vm.ApplyStream(ctx, strings.NewReader(":bash: {{slow}} sleep 5\n{{slow}}\n"), ioutil.Discard)
+	if notOk(err != nil) {
+		t.Fatalf("expected an error when the deadline passes")
+	}
+	if notOk(time.Since(start) < 4*time.Second) {
+		t.Errorf("run was not stopped, took %s", time.Since(start))
+	}
+	if notOk(strings.Contains(err.Error(), "sleep 5")) {
+		t.Errorf("expected the command in the error, got %q", err)
+	}
+	if notOk(vm.Context() == context.Background()) {
+		t.Errorf("expected ApplyStream to restore the VM's context")
+	}
+
+	// Apply uses the context set with SetContext
+	vm.SetContext(ctx)
+	start = time.Now()
+	_, err = vm.Apply([]byte(":bash: {{slow}} sleep 5\n{{slow}}\n"))
+	if notOk(err != nil && errors.Is(err, context.DeadlineExceeded)) {
+		t.Errorf("expected the deadline to stop Apply, got %v", err)
+	}
+	if notOk(time.Since(start) < 4*time.Second) {
+		t.Errorf("Apply was not stopped, took %s", time.Since(start))
+	}
+}
+
+func TestRunners(t *testing.T) {
+	fake := NewFakeRunner()
+	fake.Outputs["date +%Y"] = "2019\n"
+	fake.Outputs["cat {{name}}.txt"] = "raw"
+	fake.Outputs["cat notes.txt"] = "notes"
+	fake.Errors["false"] = fmt.Errorf("exit status 1")
+
+	vm := New()
+	vm.Runner = fake
+	src := []byte(`:set: {{name}} notes
+:bash: {{year}} date +%Y
+:bash: {{raw}} cat {{name}}.txt
+:expand-and-bash: {{notes}} cat {{name}}.txt
+{{year}}{{raw}} {{notes}}`)
+	out, err := vm.Apply(src)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if expected := "\n\n\n\n2019\nraw notes"; string(out) != expected {
+		t.Errorf("expected %q, got %q", expected, out)
+	}
+	expected := []string{"date +%Y", "cat {{name}}.txt", "cat notes.txt"}
+	commands := []string{}
+	for _, cmd := range fake.Commands {
+		commands = append(commands, cmd.Line)
+	}
+	if notOk(strings.Join(commands, "|") == strings.Join(expected, "|")) {
+		t.Errorf("expected commands %q, got %q", expected, commands)
+	}
+	if _, err := vm.Eval(":bash: {{fail}} false", 7); notOk(err != nil) {
+		t.Errorf("expected the fake error")
+	}
+
+	// Shells and running without one
+	for _, name := range []string{"bash", "sh", "none"} {
+		runner, err := ParseRunner(name)
+		if err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		out, err := runner.Run(context.Background(), Command{Line: `echo "hello   world" it\'s`})
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", name, err)
+		}
+		if expected := "hello   world it's\n"; out.Stdout != expected {
+			t.Errorf("%s: expected %q, got %q", name, expected, out.Stdout)
+		}
+	}
+	if _, err := ParseRunner("bash -x"); notOk(err != nil) {
+		t.Errorf("expected an error for a shell with spaces")
+	}
+
+	args, err := SplitArgs(`cp 'a b' "c\"d" e\ f`)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if expected := []string{"cp", "a b", `c"d`, "e f"}; notOk(strings.Join(args, "|") == strings.Join(expected, "|")) {
+		t.Errorf("expected %q, got %q", expected, args)
+	}
+	if _, err := SplitArgs(`echo "oops`); notOk(err != nil) {
+		t.Errorf("expected an error for an unterminated quote")
+	}
+	if out, err := DirectRunner.Run(context.Background(), Command{Line: "echo $HOME | cat"}); err != nil || out.Stdout != "$HOME | cat\n" {
+		t.Errorf("expected no shell processing, got %q, %v", out, err)
+	}
+}
+
+func TestShellEnv(t *testing.T) {
+	vm := New()
+	src := []byte(`:set: {{title}} Tom's "quoted" $(title)
+:set: {{body}} <<END
+one two
+three
+END
+:bash-env: {{out}} <{{body}} {{title}} -- printf '%s|' "$title"; wc -l | tr -d ' '
+{{out}}`)
+	out, err := vm.Apply(src)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if expected := "Tom's \"quoted\" $(title)|1\n"; strings.HasSuffix(string(out), expected) == false {
+		t.Errorf("expected %q, got %q", expected, out)
+	}
+
+	// The fake runner sees the environment and standard input
+	fake := NewFakeRunner()
+	fake.Outputs["wc -w"] = "3"
+	vm.Runner = fake
+	if _, err := vm.Eval(":bash-env: {{count}} {{title}}  <{{body}} --   wc -w", 9); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	cmd := fake.Commands[0]
+	if notOk(cmd.Line == "wc -w" && cmd.Stdin == "one two\nthree" && len(cmd.Env) == 1 && cmd.Env[0] == `title=Tom's "quoted" $(title)`) {
+		t.Errorf("unexpected command %+v", cmd)
+	}
+
+	for _, src := range []string{
+		":bash-env: {{x}} {{title}} wc -w",
+		":bash-env: {{x}} {{missing}} -- wc -w",
+		":bash-env: {{x}} {{title}} --",
+	} {
+		if _, err := vm.Eval(src, 10); notOk(err != nil) {
+			t.Errorf("expected an error for %q", src)
+		}
+	}
+	vm.Symbols.SetSymbol(SourceMap{Label: "{{bad-name}}", Op: ":set:", Source: "x", Expanded: "x"})
+	if _, err := vm.Eval(":bash-env: {{x}} {{bad-name}} -- wc -w", 11); notOk(err != nil) {
+		t.Errorf("expected an error for a label that is not a variable name")
+	}
+
+	ls := AtSign
+	if name, err := ls.EnvName("@pageTitle"); err != nil || name != "pageTitle" {
+		t.Errorf("expected pageTitle, got %q, %v", name, err)
+	}
+	if _, err := ls.EnvName("@2x"); notOk(err != nil) {
+		t.Errorf("expected an error for a name starting with a digit")
+	}
+}
+
+func TestShellErrors(t *testing.T) {
+	vm := New()
+	_, err := vm.Eval(":bash: {{x}} echo oops >&2; exit 3", 5)
+	if notOk(err != nil) {
+		t.Fatalf("expected an error")
+	}
+	if expected := `<input>:5:14: command "echo oops >&2; exit 3" failed with exit status 3: oops`; err.Error() != expected {
+		t.Errorf("expected %q, got %q", expected, err)
+	}
+
+	src := []byte(`:bash-capture: {{out}} {{err}} {{status}} echo partial; echo oops >&2; exit 2
+:bash-capture: {{ok}} {{okErr}} {{okStatus}} echo -n fine
+{{out}}[{{err}}] {{status}} {{ok}} {{okStatus}}`)
+	out, err := vm.Apply(src)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if expected := "partial\n[oops\n] 2 fine 0"; strings.HasSuffix(string(out), expected) == false {
+		t.Errorf("expected %q, got %q", expected, out)
+	}
+
+	if _, err := vm.Eval(":bash-capture: {{x}} {{y}}", 8); notOk(err != nil) {
+		t.Errorf("expected an error for a missing command")
+	}
+	vm.Eval(":const: {{fixed}} 1", 9)
+	if _, err := vm.Eval(":bash-capture: {{x}} {{y}} {{fixed}} true", 10); notOk(err != nil) {
+		t.Errorf("expected an error assigning a constant")
+	}
+
+	fake := NewFakeRunner()
+	fake.Results["make"] = Result{Stdout: "built", Stderr: "warning", Status: 1}
+	vm.Runner = fake
+	if _, err := vm.Eval(":bash: {{x}} make", 11); notOk(err != nil && strings.Contains(err.Error(), "exit status 1: warning")) {
+		t.Errorf("expected the fake result in the error, got %v", err)
+	}
+
+	// A constant output label stops the command before it runs
+	fake.Commands = nil
+	vm.SetFilename("page.shorthand")
+	if _, err := vm.Eval(":bash-capture: {{fixed}} {{e2}} {{s2}} make", 12); notOk(err != nil && len(fake.Commands) == 0) {
+		t.Errorf("expected an error without running make, got %v, ran %v", err, fake.Commands)
+	}
+	if notOk(vm.Symbols.defined("{{e2}}") == false && vm.Symbols.defined("{{s2}}") == false) {
+		t.Errorf("expected no labels to be assigned")
+	}
+	vm.Eval(":bash-capture: {{o3}} {{e3}} {{s3}} make", 13)
+	if sm := vm.Symbols.GetSymbol("{{s3}}"); notOk(sm.Expanded == "1" && sm.Filename == "page.shorthand" && sm.LineNo == 13 && sm.Column == 23) {
+		t.Errorf("expected the status label to have its position, got %+v", sm)
+	}
+
+	// The captured labels can be exported and imported again
+	files := NewMemFS()
+	vm = New()
+	vm.ReadFS, vm.WriteFS, vm.Runner = files, files, fake
+	vm.Eval(":bash-capture: {{o3}} {{e3}} {{s3}} make", 1)
+	if _, err := vm.Eval(":export-all-shorthand: _ captured.shorthand", 2); err != nil {
+		t.Fatalf("export error: %s", err)
+	}
+	imported := New()
+	imported.ReadFS, imported.Runner = files, fake
+	if _, err := imported.Eval(":import-shorthand: _ captured.shorthand", 1); err != nil {
+		t.Fatalf("import error: %s", err)
+	}
+	if s := imported.Expand("{{o3}}|{{e3}}|{{s3}}"); notOk(s == "built|warning|1") {
+		t.Errorf("expected the captured labels to be imported, got %q", s)
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	root, err := ioutil.TempDir("", "shorthand")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(root)
+	if err := ioutil.WriteFile(root+"/inside.txt", []byte("inside"), 0666); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := os.Symlink("/etc", root+"/etc"); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	vm := NewSandboxed(Sandbox{Root: root, Commands: []string{"echo"}})
+	if _, err := vm.Eval(":import-text: {{in}} inside.txt", 1); err != nil {
+		t.Errorf("unexpected error %s", err)
+	}
+	if s := vm.Symbols.GetSymbol("{{in}}").Expanded; s != "inside" {
+		t.Errorf("expected inside, got %q", s)
+	}
+	if _, err := vm.Eval(":export: {{in}} copy.txt", 2); err != nil {
+		t.Errorf("unexpected error %s", err)
+	}
+	if buf, err := ioutil.ReadFile(root + "/copy.txt"); err != nil || string(buf) != "inside" {
+		t.Errorf("expected copy.txt in the root, got %q, %v", buf, err)
+	}
+	for _, src := range []string{
+		":import-text: {{x}} ../outside.txt",
+		":import-text: {{x}} /etc/hostname",
+		":import-text: {{x}} etc/hostname",
+		":import: {{x}} etc/hostname",
+		":import-shorthand: {{x}} etc/hostname",
+		":export: {{in}} ../outside.txt",
+		":export-all: _ etc/outside.txt",
+		":bash: {{x}} date",
+		":bash: {{x}} echo hi; date",
+		":bash: {{x}} echo $(date)",
+		":expand-and-bash: {{x}} echo hi | cat",
+	} {
+		if _, err := vm.Eval(src, 3); notOk(err != nil) {
+			t.Errorf("expected %q to be refused", src)
+		}
+	}
+	if _, err := vm.Eval(":bash: {{x}} echo 'hi there'", 4); err != nil {
+		t.Errorf("unexpected error %s", err)
+	}
+	if s := vm.Symbols.GetSymbol("{{x}}").Expanded; s != "hi there\n" {
+		t.Errorf("expected the allowed command to run, got %q", s)
+	}
+
+	// Labels passed as environment variables can't make the shell run anything else
+	pwned := root + "-pwned"
+	defer os.Remove(pwned)
+	vm = NewSandboxed(Sandbox{Root: root, Commands: []string{"date", "printenv"}, Env: []string{"title"}})
+	for i, src := range []string{
+		":set: {{payload}} touch " + pwned,
+		":export: {{payload}} evil.sh",
+		":set: {{BASH_ENV}} " + root + "/evil.sh",
+	} {
+		if _, err := vm.Eval(src, i+1); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+	}
+	for _, label := range []string{"{{BASH_ENV}}", "{{ENV}}", "{{PATH}}", "{{IFS}}", "{{PS4}}", "{{LD_PRELOAD}}", "{{GCONV_PATH}}", "{{GLIBC_TUNABLES}}", "{{BASH_XTRACEFD}}", "{{TZDIR}}", "{{Title}}"} {
+		vm.Eval(":set: "+label+" "+root+"/evil.sh", 4)
+		src := ":bash-env: {{x}} " + label + " -- date"
+		if _, err := vm.Eval(src, 5); notOk(err != nil && strings.Contains(err.Error(), "is not an allowed variable")) {
+			t.Errorf("expected %q to be refused, got %v", src, err)
+		}
+	}
+	if _, err := os.Stat(pwned); notOk(os.IsNotExist(err)) {
+		t.Errorf("expected %s not to be created", pwned)
+	}
+	// Sandboxed commands only get the variables they're given
+	os.Setenv("SHORTHAND_TEST_SECRET", "secret")
+	defer os.Unsetenv("SHORTHAND_TEST_SECRET")
+	vm.Eval(":set: {{title}} My Page", 6)
+	if _, err := vm.Eval(":bash-env: {{env}} {{title}} -- printenv", 7); err != nil {
+		t.Errorf("unexpected error %s", err)
+	}
+	if env := vm.Symbols.GetSymbol("{{env}}").Expanded; notOk(strings.Contains(env, "title=My Page") && strings.Contains(env, "SHORTHAND_TEST_SECRET") == false) {
+		t.Errorf("expected only the label in the environment, got %q", env)
+	}
+
+	vm = NewSandboxed(Sandbox{Root: root, ReadOnly: true})
+	vm.Eval(":set: {{in}} changed", 1)
+	for _, src := range []string{
+		":export: {{in}} copy.txt",
+		":export-all: _ all.txt",
+		":export-shorthand: {{in}} in.shorthand",
+		":export-all-shorthand: _ all.shorthand",
+		":export-history: _ history.shorthand",
+	} {
+		if _, err := vm.Eval(src, 2); notOk(err != nil) {
+			t.Errorf("expected %q to be refused", src)
+		}
+	}
+	if buf, _ := ioutil.ReadFile(root + "/copy.txt"); string(buf) != "inside" {
+		t.Errorf("expected copy.txt to be unchanged, got %q", buf)
+	}
+
+	vm.SetSandbox(nil)
+	if notOk(vm.Sandbox() == nil) {
+		t.Errorf("expected the sandbox to be removed")
+	}
+}
+
+func TestFileSystems(t *testing.T) {
+	templates := fstest.MapFS{
+		"site/header.md":      {Data: []byte("# {{title}}")},
+		"site/vars.shorthand": {Data: []byte(":set: {{title}} Hello\n:import: {{header}} site/header.md\n")},
+		"site/notes/a.txt":    {Data: []byte("a note")},
+		"site/notes/b.txt":    {Data: []byte("b note")},
+	}
+	vm := New()
+	vm.ReadFS = templates
+	out := NewMemFS()
+	vm.WriteFS = out
+	src := []byte(`:import-shorthand: _ site/vars.shorthand
+:import-text: {{a}} ./site/notes/a.txt
+:export: {{header}} page.md
+:export-all-shorthand: _ all.shorthand`)
+	if _, err := vm.Apply(src); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if s := vm.Expand("{{header}} {{a}}"); s != "# Hello a note" {
+		t.Errorf("expected files from the fs.FS, got %q", s)
+	}
+	if notOk(strings.Join(out.Names(), ",") == "all.shorthand,page.md") {
+		t.Errorf("unexpected files written %q", out.Names())
+	}
+	if buf, err := out.ReadFile("page.md"); err != nil || string(buf) != "# Hello" {
+		t.Errorf("expected page.md to be written, got %q, %v", buf, err)
+	}
+	if _, err := vm.Eval(":import-text: {{x}} missing.txt", 5); notOk(err != nil) {
+		t.Errorf("expected an error for a missing file")
+	}
+	if _, err := os.Stat("page.md"); notOk(os.IsNotExist(err)) {
+		t.Errorf("page.md should not be written to the disk")
+	}
+
+	// A sandbox root is a directory of the filesystem
+	vm.SetSandbox(&Sandbox{Root: "site/notes"})
+	if _, err := vm.Eval(":import-text: {{b}} b.txt", 6); err != nil || vm.Expand("{{b}}") != "b note" {
+		t.Errorf("expected b.txt from the root, got %q, %v", vm.Expand("{{b}}"), err)
+	}
+	for _, src := range []string{
+		":import-text: {{x}} ../header.md",
+		":import-text: {{x}} ../../site/header.md",
+		":export: {{b}} ../b.txt",
+	} {
+		if _, err := vm.Eval(src, 7); notOk(err != nil) {
+			t.Errorf("expected %q to be refused", src)
+		}
+	}
+	if _, err := vm.Eval(":export: {{b}} copy.txt", 8); err != nil {
+		t.Errorf("unexpected error %s", err)
+	}
+	if _, err := out.ReadFile("site/notes/copy.txt"); err != nil {
+		t.Errorf("expected copy.txt inside the root, got %q", out.Names())
+	}
+
+	// MemFS works as an fs.FS
+	if buf, err := fs.ReadFile(out, "page.md"); err != nil || string(buf) != "# Hello" {
+		t.Errorf("expected fs.ReadFile to work, got %q, %v", buf, err)
+	}
+	if _, err := out.Open("../page.md"); notOk(errors.Is(err, fs.ErrInvalid)) {
+		t.Errorf("expected an invalid path error, got %v", err)
+	}
+	if _, err := out.Open("nothing.md"); notOk(errors.Is(err, fs.ErrNotExist)) {
+		t.Errorf("expected a not exist error, got %v", err)
+	}
+}
+
+func TestImportPaths(t *testing.T) {
+	files := NewMemFS()
+	files.WriteFile("site/index.shorthand", []byte(":import-shorthand: _ posts/post.shorthand\n:import-text: {{nav}} nav.md\n"))
+	files.WriteFile("site/nav.md", []byte("site nav"))
+	files.WriteFile("site/posts/post.shorthand", []byte(":import-text: {{body}} body.md\n:import: {{footer}} footer.md\n:import-text: {{nav}} ../nav.md\n"))
+	files.WriteFile("site/posts/body.md", []byte("post body"))
+	files.WriteFile("partials/footer.md", []byte("footer for {{body}}"))
+	files.WriteFile("nav.md", []byte("working directory nav"))
+
+	vm := New()
+	vm.ReadFS = files
+	vm.IncludePath = []string{"partials"}
+	if _, err := vm.Eval(":import-shorthand: _ site/index.shorthand", 1); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if s := vm.Expand("{{body}}|{{footer}}|{{nav}}"); s != "post body|footer for post body|site nav" {
+		t.Errorf("expected imports relative to the importing file, got %q", s)
+	}
+
+	// Without an importing file names are relative to the working directory
+	if _, err := vm.Eval(":import-text: {{nav}} nav.md", 2); err != nil || vm.Expand("{{nav}}") != "working directory nav" {
+		t.Errorf("expected nav.md from the working directory, got %q, %v", vm.Expand("{{nav}}"), err)
+	}
+
+	// Errors name the resolved file
+	files.WriteFile("site/broken.shorthand", []byte(":import-text: {{x}} missing.md\n"))
+	_, err := vm.Eval(":import-shorthand: _ site/broken.shorthand", 3)
+	if notOk(err != nil && strings.Contains(err.Error(), "site/missing.md")) {
+		t.Errorf("expected the resolved path in the error, got %v", err)
+	}
+
+	vm = New()
+	_, err = vm.Eval(":import-text: {{x}} testdata/missing.md", 1)
+	cwd, _ := os.Getwd()
+	if notOk(err != nil && strings.Contains(err.Error(), "cannot read "+cwd+"/testdata/missing.md")) {
+		t.Errorf("expected the full path in the error, got %v", err)
+	}
+}
+
+func TestImportRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shorthand")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(dir+"/site/sub", 0777); err != nil {
+		t.Fatalf("%s", err)
+	}
+	for name, text := range map[string]string{
+		"site/sub/index.shorthand": ":import-text: {{nav}} nav.txt\n:import-shorthand: _ part.shorthand\n",
+		"site/sub/nav.txt":         "sub nav",
+		"site/sub/part.shorthand":  ":import-text: {{part}} nav.txt\n",
+		"site/sub/self.shorthand":  ":import-shorthand: _ self.shorthand\n",
+	} {
+		if err := ioutil.WriteFile(dir+"/"+name, []byte(text), 0666); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+	cwd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.Chdir(cwd)
+
+	// The file being run is named relative to the working directory,
+	// its imports are read next to it inside the Root
+	for _, fname := range []string{"site/sub/index.shorthand", "site/sub/self.shorthand"} {
+		fp, err := os.Open(fname)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		defer fp.Close()
+		vm := NewSandboxed(Sandbox{Root: "site"})
+		vm.Eout = ioutil.Discard
+		vm.SetFilename(fname)
+		vm.SetErrorMode(CollectAll)
+		vm.Run(bufio.NewReader(fp))
+		if fname == "site/sub/index.shorthand" {
+			if s := vm.Expand("{{nav}}|{{part}}"); notOk(len(vm.Errors) == 0 && s == "sub nav|sub nav") {
+				t.Errorf("expected the imports next to %s, got %q, %v", fname, s, vm.Errors)
+			}
+			continue
+		}
+		if notOk(len(vm.Errors) == 1 && strings.Contains(vm.Errors.Error(), "import cycle "+dir+"/"+fname+":1:22 -> "+dir+"/"+fname)) {
+			t.Errorf("expected a cycle importing %s, got %v", fname, vm.Errors)
+		}
+	}
+}
+
+func TestImportCycles(t *testing.T) {
+	files := NewMemFS()
+	files.WriteFile("a.shorthand", []byte(":set: {{a}} A\n:import-shorthand: _ b.shorthand\n"))
+	files.WriteFile("b.shorthand", []byte(":set: {{b}} B\n:set: {{c}} C\n:import-shorthand: _ a.shorthand\n"))
+	files.WriteFile("self.shorthand", []byte(":import-shorthand: _ self.shorthand\n"))
+	files.WriteFile("scoped.shorthand", []byte(":import-scoped: _ scoped.shorthand\n"))
+	files.WriteFile("part.shorthand", []byte(":set: {{part}} part\n"))
+	files.WriteFile("twice.shorthand", []byte(":import-shorthand: _ part.shorthand\n:import-shorthand: _ part.shorthand\n"))
+	for i := 1; i <= 5; i++ {
+		files.WriteFile(fmt.Sprintf("deep%d.shorthand", i), []byte(fmt.Sprintf(":import-shorthand: _ deep%d.shorthand\n", i+1)))
+	}
+	files.WriteFile("deep6.shorthand", []byte(":set: {{deep}} bottom\n"))
+
+	vm := New()
+	vm.ReadFS = files
+	vm.SetFilename("main.shorthand")
+	_, err := vm.Eval(":import-shorthand: _ a.shorthand", 4)
+	if notOk(err != nil && strings.Contains(err.Error(), "import cycle main.shorthand:4:22 -> a.shorthand:2:22 -> b.shorthand:3:22 -> a.shorthand")) {
+		t.Errorf("expected the chain of imports, got %v", err)
+	}
+	if notOk(len(vm.imports) == 0) {
+		t.Errorf("expected the import stack to be empty, got %+v", vm.imports)
+	}
+
+	vm.SetFilename("")
+	_, err = vm.Eval(":import-shorthand: _ self.shorthand", 1)
+	if notOk(err != nil && strings.Contains(err.Error(), "import cycle <input>:1:22 -> self.shorthand:1:22 -> self.shorthand")) {
+		t.Errorf("expected a cycle importing itself, got %v", err)
+	}
+	_, err = vm.Eval(":import-scoped: _ scoped.shorthand", 1)
+	if notOk(err != nil && strings.Contains(err.Error(), "import cycle <input>:1:19 -> scoped.shorthand:1:19 -> scoped.shorthand")) {
+		t.Errorf("expected a cycle importing itself in a scope, got %v", err)
+	}
+
+	// Importing a file more than once is not a cycle
+	if _, err := vm.Eval(":import-shorthand: _ twice.shorthand", 2); err != nil {
+		t.Errorf("unexpected error %s", err)
+	}
+
+	if _, err := vm.Eval(":import-shorthand: _ deep1.shorthand", 3); err != nil || vm.Expand("{{deep}}") != "bottom" {
+		t.Errorf("expected deep imports to work, got %v", err)
+	}
+	vm.MaxIncludeDepth = 3
+	_, err = vm.Eval(":import-shorthand: _ deep1.shorthand", 4)
+	if notOk(err != nil && strings.Contains(err.Error(), "import of deep4.shorthand exceeds the maximum include depth of 3")) {
+		t.Errorf("expected an include depth error, got %v", err)
+	}
+}
+
+func TestSourcePositions(t *testing.T) {
+	vm := New()
+	vm.SetFilename("page.shorthand")
+	sm := vm.Parse(":set:  {{title}}   My Page", 3)
+	if notOk(sm.Filename == "page.shorthand" && sm.LineNo == 3 && sm.Column == 20) {
+		t.Errorf("unexpected position %+v", sm)
+	}
+	if s := sm.Position(); notOk(s == "page.shorthand:3:20") {
+		t.Errorf("expected page.shorthand:3:20, got %q", s)
+	}
+	if s := (SourceMap{LineNo: 2, Column: 1}).Position(); notOk(s == "<input>:2:1") {
+		t.Errorf("expected <input>:2:1, got %q", s)
+	}
+
+	// Assignments keep where they were made
+	vm.Eval(":set: {{title}} My Page", 4)
+	if got := vm.Symbols.GetSymbol("{{title}}"); notOk(got.Filename == "page.shorthand" && got.LineNo == 4 && got.Column == 17) {
+		t.Errorf("unexpected position %+v", got)
+	}
+
+	// Errors in imported files point into the imported file
+	files := NewMemFS()
+	files.WriteFile("inc/vars.shorthand", []byte(":set: {{a}} A\n\n  {{a}}\n:expand-version: {{b}} {{a}} 9\n"))
+	files.WriteFile("inc/heredoc.shorthand", []byte(":set: {{a}} A\n:set: {{b}} <<END\nnever ends\n"))
+	vm.ReadFS = files
+	for src, expected := range map[string]string{
+		":import-shorthand: _ inc/vars.shorthand":    "inc/vars.shorthand:4:24: {{a}} has no version 9",
+		":import-shorthand: _ inc/heredoc.shorthand": "inc/heredoc.shorthand:2:1: heredoc <<END starting at line 2 is not terminated",
+		":import-text: {{x}} inc/missing.txt":        "page.shorthand:5:21: cannot read inc/missing.txt: file does not exist",
+	} {
+		_, err := vm.Eval(src, 5)
+		if notOk(err != nil && err.Error() == expected) {
+			t.Errorf("%s expected %q, got %v", src, expected, err)
+		}
+	}
+
+	// Errors from Run start with the position
+	vm = New()
+	eout := new(bytes.Buffer)
+	vm.Eout, vm.Out = eout, ioutil.Discard
+	vm.SetFilename("run.shorthand")
+	vm.Run(bufio.NewReader(strings.NewReader("text\n:unset: {{nothing}}\n")))
+	if notOk(eout.String() == "run.shorthand:2:9: {{nothing}} is not defined\n") {
+		t.Errorf("unexpected errors %q", eout.String())
+	}
+}
+
+func TestErrorTypes(t *testing.T) {
+	vm := New()
+	files := NewMemFS()
+	files.WriteFile("inc/bad.shorthand", []byte(":set: {{a}} A\n:bash: {{b}} exit 4\n"))
+	vm.ReadFS = files
+	vm.SetFilename("page.shorthand")
+	fake := NewFakeRunner()
+	fake.Results["exit 4"] = Result{Stderr: "four", Status: 4}
+	vm.Runner = fake
+
+	// Only a SourceMap passed to EvalSymbol can have an operator without
+	// a function, the same line parsed is text
+	err := vm.EvalSymbol(SourceMap{Label: "{{x}}", Op: ":unknown:", Source: "y", Filename: "page.shorthand", LineNo: 2, Column: 17})
+	var unknown *UnknownOperatorError
+	if notOk(errors.Is(err, ErrUnknownOperator) && errors.As(err, &unknown) && unknown.SourceMap.Op == ":unknown:" && unknown.SourceMap.LineNo == 2) {
+		t.Errorf("expected an UnknownOperatorError, got %#v", err)
+	}
+	if expected := "page.shorthand:2:1: `:unknown: {{x}} y` is not a supported assignment"; notOk(err != nil && err.Error() == expected) {
+		t.Errorf("expected %q, got %v", expected, err)
+	}
+	if s, err := vm.Eval(":unknown: {{x}} y", 2); notOk(err == nil && s == ":unknown: {{x}} y") {
+		t.Errorf("expected an unregistered operator to be text, got %q, %v", s, err)
+	}
+
+	_, err = vm.Eval(":import-text: {{x}} missing.txt", 3)
+	var ioErr *IOError
+	if notOk(errors.Is(err, ErrIO) && errors.Is(err, fs.ErrNotExist) && errors.As(err, &ioErr) && ioErr.Op == "read" && ioErr.Path == "missing.txt" && ioErr.SourceMap.Label == "{{x}}") {
+		t.Errorf("expected an IOError, got %#v", err)
+	}
+
+	// Errors in imported files keep their own position
+	_, err = vm.Eval(":import-shorthand: _ inc/bad.shorthand", 4)
+	var shellErr *ShellError
+	if notOk(errors.Is(err, ErrShell) && errors.As(err, &shellErr) && shellErr.Status == 4 && shellErr.Stderr == "four" && shellErr.Command == "exit 4") {
+		t.Fatalf("expected a ShellError, got %#v", err)
+	}
+	if notOk(shellErr.SourceMap.Filename == "inc/bad.shorthand" && shellErr.SourceMap.LineNo == 2) {
+		t.Errorf("expected the position in the imported file, got %+v", shellErr.SourceMap)
+	}
+	if expected := "inc/bad.shorthand:2:14: command \"exit 4\" failed with exit status 4: four"; notOk(err.Error() == expected) {
+		t.Errorf("expected %q, got %q", expected, err)
+	}
+	if notOk(errors.Is(err, ErrIO) == false && errors.Is(err, ErrUnknownOperator) == false) {
+		t.Errorf("a ShellError should only match ErrShell")
+	}
+
+	// Timeouts are shell errors caused by the context
+	vm = New()
+	vm.CommandTimeout = 50 * time.Millisecond
+	_, err = vm.Eval(":bash: {{x}} sleep 5", 1)
+	if notOk(errors.Is(err, ErrShell) && errors.Is(err, context.DeadlineExceeded)) {
+		t.Errorf("expected a shell timeout, got %v", err)
+	}
+
+	// Read only sandboxes and other errors
+	vm.SetSandbox(&Sandbox{ReadOnly: true})
+	vm.WriteFS = NewMemFS()
+	vm.Eval(":set: {{x}} x", 2)
+	_, err = vm.Eval(":export: {{x}} x.txt", 3)
+	if notOk(errors.Is(err, ErrReadOnly) && errors.As(err, &ioErr) && ioErr.Op == "write") {
+		t.Errorf("expected a read only IOError, got %v", err)
+	}
+	_, err = vm.Eval(":expand-version: {{y}} {{x}} 7", 4)
+	var e *Error
+	if notOk(errors.As(err, &e) && e.SourceMap.LineNo == 4 && strings.HasSuffix(err.Error(), "{{x}} has no version 7")) {
+		t.Errorf("expected an Error, got %#v", err)
+	}
+	if err := vm.ApplyStream(context.Background(), strings.NewReader("ok\n:expand-version: {{y}} {{x}} 7\n"), ioutil.Discard); notOk(strings.Count(err.Error(), ":2:") == 1) {
+		t.Errorf("expected the line number once, got %q", err)
+	}
+}
+
+func TestErrorModes(t *testing.T) {
+	files := NewMemFS()
+	files.WriteFile("nav.shorthand", []byte(":import-shorthand: _ missing.shorthand\n:bash: {{a}} exit 1\n:set: {{nav}} Nav\n"))
+	src := []byte(":import-shorthand: _ nav.shorthand\n:import-text: {{footer}} footer.txt\n:bash: {{b}} exit 2\n{{nav}} ok\n")
+	setup := func(mode ErrorMode) *VirtualMachine {
+		vm := New()
+		vm.ReadFS = files
+		vm.SetFilename("index.shorthand")
+		fake := NewFakeRunner()
+		fake.Results["exit 1"] = Result{Status: 1}
+		fake.Results["exit 2"] = Result{Status: 2}
+		vm.Runner = fake
+		vm.SetErrorMode(mode)
+		return vm
+	}
+
+	// The default stops Apply at the first error
+	_, err := setup(DefaultErrors).Apply(src)
+	var ioErr *IOError
+	if notOk(errors.As(err, &ioErr) && ioErr.Path == "missing.shorthand") {
+		t.Errorf("expected the missing import, got %v", err)
+	}
+	if _, ok := err.(ErrorList); notOk(ok == false) {
+		t.Errorf("expected a single error, got %v", err)
+	}
+
+	// CollectAll returns every error, including those in imported files
+	vm := setup(CollectAll)
+	out, err := vm.Apply(src)
+	list, ok := err.(ErrorList)
+	if notOk(ok && len(list) == 4) {
+		t.Fatalf("expected 4 errors, got %v", err)
+	}
+	expected := []string{
+		"nav.shorthand:1:22: cannot read missing.shorthand: file does not exist",
+		"nav.shorthand:2:14: command \"exit 1\" failed with exit status 1",
+		"index.shorthand:2:26: cannot read footer.txt: file does not exist",
+		"index.shorthand:3:14: command \"exit 2\" failed with exit status 2",
+	}
+	for i, e := range list {
+		if notOk(e.Error() == expected[i]) {
+			t.Errorf("expected %q, got %q", expected[i], e)
+		}
+	}
+	var shellErr *ShellError
+	if notOk(errors.Is(err, ErrIO) && errors.Is(err, ErrShell) && errors.Is(err, fs.ErrNotExist) && errors.As(err, &shellErr) && shellErr.Status == 1) {
+		t.Errorf("expected errors.Is and errors.As to check each error, got %v", err)
+	}
+	if notOk(strings.Contains(string(out), "Nav ok")) {
+		t.Errorf("expected processing to continue, got %q", out)
+	}
+
+	// Run keeps the errors for FailFast and CollectAll
+	for _, test := range []struct {
+		mode   ErrorMode
+		errors int
+		output string
+	}{
+		{DefaultErrors, 0, "{{nav}} ok"},
+		{FailFast, 1, ""},
+		{CollectAll, 4, "Nav ok"},
+	} {
+		vm := setup(test.mode)
+		vm.SetPrompt("")
+		stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+		vm.Out, vm.Eout = stdout, stderr
+		vm.Run(bufio.NewReader(bytes.NewReader(src)))
+		if notOk(len(vm.Errors) == test.errors) {
+			t.Errorf("mode %d: expected %d errors, got %v", test.mode, test.errors, vm.Errors)
+		}
+		if notOk(strings.Contains(stdout.String(), test.output)) {
+			t.Errorf("mode %d: expected %q in the output, got %q", test.mode, test.output, stdout)
+		}
+		if test.mode == FailFast && notOk(strings.Count(stderr.String(), "\n") == 1) {
+			t.Errorf("expected one error reported, got %q", stderr)
+		}
+	}
+}
+
+func TestConditionals(t *testing.T) {
+	vm := New()
+	src := []string{
+		":set: {{page}} About us",
+		":set: {{nav}}  ",
+		":if-equals: {{class}} {{page}} \"About us\" active :else: inactive",
+		":if-equals: {{home}} {{page}} index active",
+		":if-defined: {{hi}} {{name}} Hello {{name}} :else: Hello {{page}}",
+		":if-empty: {{navClass}} {{nav}} hidden :else: shown",
+	}
+	for i, s := range src {
+		if _, err := vm.Eval(s, i+1); err != nil {
+			t.Fatalf("line %d: %s", i+1, err)
+		}
+	}
+	for label, expected := range map[string]string{"{{class}}": "active", "{{home}}": "", "{{hi}}": "Hello About us", "{{navClass}}": "hidden"} {
+		if sm := vm.Symbols.GetSymbol(label); notOk(sm.Expanded == expected) {
+			t.Errorf("expected %s to be %q, got %q", label, expected, sm.Expanded)
+		}
+	}
+	for _, s := range []string{":if-defined: {{x}}", ":if-equals: {{x}} {{page}}", ":if-equals: {{x}} {{page}} \"About"} {
+		if _, err := vm.Eval(s, 1); notOk(err != nil) {
+			t.Errorf("expected an error for %q", s)
+		}
+	}
+
+	// Sections, the lines of a hidden section are not evaluated
+	vm = New()
+	fake := NewFakeRunner()
+	vm.Runner = fake
+	text := `:set: {{page}} index
+:if: not empty {{nav}}
+<nav>{{nav}}</nav>
+:bash: {{x}} hidden
+:else:
+:if: equals {{page}} index
+Home
+:else:
+<a href="index.html">Home</a>
+:end-if:
+:end-if:
+:if: defined {{page}}
+\:if: is written as text
+:end-if:
+done`
+	out, err := vm.Apply([]byte(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "\nHome\n:if: is written as text\ndone"; notOk(string(out) == expected) {
+		t.Errorf("expected %q, got %q", expected, out)
+	}
+	if notOk(len(fake.Commands) == 0 && vm.Symbols.defined("{{x}}") == false && vm.Symbols.defined("not") == false) {
+		t.Errorf("expected the hidden section to be skipped, ran %v", fake.Commands)
+	}
+
+	// Sections must be closed in the file they start in
+	files := NewMemFS()
+	files.WriteFile("nav.shorthand", []byte(":if: defined {{page}}\n:set: {{nav}} Nav\n"))
+	vm = New()
+	vm.ReadFS = files
+	for _, test := range []struct {
+		src      string
+		expected string
+	}{
+		{":if: defined {{page}}\nok", "<input>:1:1: :if: is not closed by :end-if:"},
+		{":else:", "<input>:1:1: :else: without :if:"},
+		{"ok\n:end-if:", "<input>:2:1: :end-if: without :if:"},
+		{":if: empty {{x}}\n:else:\n:else:\n:end-if:", "<input>:3:1: :else: already used by the :if: at line 1"},
+		{":if: blank {{x}}\n:end-if:", "<input>:1:1: unknown test \"blank\", expected defined, empty or equals"},
+		{":if: defined {{x}}\n:import-shorthand: _ nav.shorthand\n:end-if:", ""},
+		{":if: not defined {{x}}\n:import-shorthand: _ nav.shorthand\n:end-if:", "nav.shorthand:1:1: :if: is not closed by :end-if:"},
+	} {
+		_, err := vm.Apply([]byte(test.src))
+		if test.expected == "" {
+			if notOk(err == nil) {
+				t.Errorf("%q: expected no error, got %s", test.src, err)
+			}
+		} else if notOk(err != nil && err.Error() == test.expected) {
+			t.Errorf("%q: expected %q, got %v", test.src, test.expected, err)
+		}
+	}
+}